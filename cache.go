@@ -9,6 +9,8 @@
 package cache2go
 
 import (
+	"context"
+	"sort"
 	"sync"
 )
 
@@ -18,8 +20,9 @@ var (
 )
 
 // Cache returns the existing cache table with given name or creates a new one
-// if the table does not exist yet.
-func Cache(table string, expireByCreateTime bool) *CacheTable {
+// if the table does not exist yet. The options only apply when creating a new
+// table.
+func Cache(table string, expireByCreateTime bool, opts ...Option) *CacheTable {
 	mutex.RLock()
 	t, ok := cache[table]
 	mutex.RUnlock()
@@ -29,10 +32,9 @@ func Cache(table string, expireByCreateTime bool) *CacheTable {
 		t, ok = cache[table]
 		// Double check whether the table exists or not.
 		if !ok {
-			t = &CacheTable{
-				name:               table,
-				items:              make(map[interface{}]*CacheItem),
-				expireByCreateTime: expireByCreateTime,
+			t = newCacheTable(table, expireByCreateTime)
+			for _, opt := range opts {
+				opt(t)
 			}
 			cache[table] = t
 		}
@@ -41,3 +43,70 @@ func Cache(table string, expireByCreateTime bool) *CacheTable {
 
 	return t
 }
+
+// newCacheTable returns a new, unregistered cache table.
+func newCacheTable(name string, expireByCreateTime bool) *CacheTable {
+	return &CacheTable{
+		name:               name,
+		items:              make(map[interface{}]*CacheItem),
+		expireByCreateTime: expireByCreateTime,
+	}
+}
+
+// RenameTable moves the cache table oldName to newName. The table keeps its
+// items and callbacks, and Cache(newName, ...) returns the same instance
+// afterwards. It fails if oldName doesn't exist or newName is already taken.
+func RenameTable(ctx context.Context, oldName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	t, ok := cache[oldName]
+	if !ok {
+		return ErrTableNotFound
+	}
+	if _, ok := cache[newName]; ok {
+		return ErrTableExists
+	}
+
+	t.Lock()
+	t.name = newName
+	t.Unlock()
+
+	delete(cache, oldName)
+	cache[newName] = t
+	return nil
+}
+
+// Tables returns the names of all registered cache tables in sorted order.
+func Tables() []string {
+	mutex.RLock()
+	names := make([]string, 0, len(cache))
+	for name := range cache {
+		names = append(names, name)
+	}
+	mutex.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// DropTable stops the cache table with the given name and removes it from the
+// cache, see CacheTable.Stop.
+func DropTable(name string) error {
+	mutex.Lock()
+	t, ok := cache[name]
+	if ok {
+		delete(cache, name)
+	}
+	mutex.Unlock()
+	if !ok {
+		return ErrTableNotFound
+	}
+
+	t.Stop()
+	return nil
+}
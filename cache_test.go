@@ -8,6 +8,19 @@
 package cache2go
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -22,3 +35,2617 @@ func TestCacheNew(t *testing.T) {
 	table.Add(k+"_1", 10*time.Second, v)
 
 }
+
+func BenchmarkExists(b *testing.B) {
+	table := Cache("benchmarkExists", false)
+	table.Add(k, 0, v)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Exists(k)
+	}
+}
+
+func BenchmarkValue(b *testing.B) {
+	table := Cache("benchmarkValue", false)
+	table.Add(k, 0, v)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = table.Value(k)
+	}
+}
+
+func TestCount(t *testing.T) {
+	table := Cache("testCount", false)
+	count := 100000
+	for i := 0; i < count; i++ {
+		key := k + strconv.Itoa(i)
+		table.Add(key, 10*time.Second, v)
+	}
+	for i := 0; i < count; i++ {
+		key := k + strconv.Itoa(i)
+		p, err := table.Value(key)
+		if err != nil || p == nil || p.Data().(string) != v {
+			t.Error("Error retrieving data")
+		}
+	}
+	if table.Count() != count {
+		t.Error("Data count mismatch")
+	}
+}
+
+func TestForeach(t *testing.T) {
+	table := Cache("testForeach", false)
+	count := 100
+	for i := 0; i < count; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+	}
+
+	// Deleting items from within the callback must not deadlock.
+	visited := 0
+	table.Foreach(func(key interface{}, item *CacheItem) {
+		if key != item.Key() {
+			t.Error("Key mismatch while iterating")
+		}
+		if _, err := table.Delete(key); err != nil {
+			t.Error("Error deleting item while iterating:", err)
+		}
+		visited++
+	})
+	if visited != count {
+		t.Error("Expected to visit", count, "items, visited", visited)
+	}
+	if table.Count() != 0 {
+		t.Error("Expected empty table after deleting all items")
+	}
+}
+
+func TestKeepAliveOnAccess(t *testing.T) {
+	table := Cache("testKeepAliveOnAccess", true)
+	table.SetKeepAliveOnAccess(true)
+	table.Add(k+"_accessed", 100*time.Millisecond, v)
+	table.Add(k+"_untouched", 100*time.Millisecond, v)
+
+	// Keep accessing one of the items well beyond its lifespan.
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := table.Value(k + "_accessed"); err != nil {
+			t.Error("Accessed item expired despite being kept alive")
+		}
+	}
+	if table.Exists(k + "_untouched") {
+		t.Error("Untouched item should have expired")
+	}
+
+	// Without keep-alive, accessing an item doesn't extend its lifespan.
+	table.SetKeepAliveOnAccess(false)
+	table.Add(k, 100*time.Millisecond, v)
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = table.Value(k)
+	}
+	if table.Exists(k) {
+		t.Error("Item should have expired regardless of being accessed")
+	}
+}
+
+func TestAddedItemCallback(t *testing.T) {
+	table := Cache("testAddedItemCallback", false)
+	var added, appended int
+	table.SetAddedItemCallback(func(item *CacheItem) {
+		added++
+	})
+	table.AddAddedItemCallback(func(item *CacheItem) {
+		appended++
+	})
+
+	count := 10
+	for i := 0; i < count; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+	}
+	if added != count || appended != count {
+		t.Error("Expected", count, "callback invocations, got", added, "and", appended)
+	}
+
+	table.RemoveAddedItemCallbacks()
+	table.Add(k, 0, v)
+	if added != count || appended != count {
+		t.Error("Removed callbacks should not be invoked")
+	}
+}
+
+func TestAboutToDeleteItemCallback(t *testing.T) {
+	table := Cache("testAboutToDeleteItemCallback", false)
+	var mu sync.Mutex
+	deleted := make(map[interface{}]bool)
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		mu.Lock()
+		defer mu.Unlock()
+		deleted[item.Key()] = true
+	})
+
+	table.Add(k+"_1", 50*time.Millisecond, v)
+	table.Add(k+"_2", 50*time.Millisecond, v)
+	table.Add(k+"_3", 0, v)
+	time.Sleep(150 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deleted) != 2 || !deleted[k+"_1"] || !deleted[k+"_2"] {
+		t.Error("Expected callback for expired items only, got", deleted)
+	}
+}
+
+func TestAboutToExpireCallback(t *testing.T) {
+	table := Cache("testAboutToExpireCallback", false)
+	expired := make(chan interface{}, 3)
+
+	withCallback := table.Add(k+"_1", 50*time.Millisecond, v)
+	withCallback.SetAboutToExpireCallback(func(key interface{}) bool {
+		expired <- key
+		return false
+	})
+	removedCallback := table.Add(k+"_2", 50*time.Millisecond, v)
+	removedCallback.AddAboutToExpireCallback(func(key interface{}) bool {
+		expired <- key
+		return false
+	})
+	removedCallback.RemoveAboutToExpireCallback()
+	table.Add(k+"_3", 50*time.Millisecond, v)
+
+	select {
+	case key := <-expired:
+		if key != k+"_1" {
+			t.Error("Unexpected key passed to expire callback:", key)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expire callback was not invoked")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(expired) != 0 {
+		t.Error("Expire callback invoked for item without callbacks")
+	}
+}
+
+func TestDataLoader(t *testing.T) {
+	table := Cache("testDataLoader", false)
+	loads := 0
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		loads++
+		if key.(string) == "nil" {
+			return nil
+		}
+		return NewCacheItem(key, 0, args[0])
+	})
+
+	for i := 0; i < 3; i++ {
+		p, err := table.Value(k, v)
+		if err != nil || p == nil || p.Data().(string) != v {
+			t.Error("Error loading data via data-loader")
+		}
+	}
+	if loads != 1 {
+		t.Error("Expected data-loader to run once, ran", loads, "times")
+	}
+
+	if _, err := table.Value("nil"); err != ErrKeyNotFoundOrLoadable {
+		t.Error("Expected ErrKeyNotFoundOrLoadable, got", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	table := Cache("testStats", false)
+	table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+	for i := 0; i < 3; i++ {
+		_, _ = table.Value(k + "_1")
+	}
+	_, _ = table.Value(k + "_missing")
+
+	if hits, misses, adds := table.Stats(); hits != 3 || misses != 1 || adds != 2 {
+		t.Error("Unexpected stats:", hits, misses, adds)
+	}
+
+	table.ResetStats()
+	if hits, misses, adds := table.Stats(); hits != 0 || misses != 0 || adds != 0 {
+		t.Error("Stats not reset:", hits, misses, adds)
+	}
+}
+
+func TestStop(t *testing.T) {
+	table := Cache("testStop", false)
+	table.Add(k, 50*time.Millisecond, v)
+	table.Stop()
+
+	if table.Count() != 0 || table.Exists(k) {
+		t.Error("Stopped table should be empty")
+	}
+	if _, err := table.Value(k); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound from stopped table, got", err)
+	}
+
+	recreated := Cache("testStop", false)
+	if recreated == table {
+		t.Error("Expected a new table after stopping the old one")
+	}
+	recreated.Add(k, 0, v)
+	if table.Exists(k) {
+		t.Error("Recreated table shares items with the stopped one")
+	}
+}
+
+func TestStopConcurrentRename(t *testing.T) {
+	table := Cache("testStopConcurrentRename", false)
+	defer func() {
+		_ = DropTable("testStopConcurrentRenamed")
+	}()
+
+	// Hold the table lock, so Stop gets stuck first and RenameTable right
+	// after it.
+	table.Lock()
+	stopped := make(chan struct{})
+	go func() {
+		table.Stop()
+		close(stopped)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	renamed := make(chan error, 1)
+	go func() {
+		renamed <- RenameTable(context.Background(), "testStopConcurrentRename", "testStopConcurrentRenamed")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	table.Unlock()
+	<-stopped
+	<-renamed
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for name, other := range cache {
+		if other == table {
+			t.Error("Expected stopped table to be unregistered, found it as", name)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	table := Cache("testLogger", false)
+	table.Add(k+"_1", 0, v)
+
+	var buf bytes.Buffer
+	table.SetLogger(log.New(&buf, "", 0))
+	table.Add(k+"_2", 0, v)
+	if !strings.Contains(buf.String(), "Adding item with key "+k+"_2") {
+		t.Error("Expected log output from table, got", buf.String())
+	}
+
+	buf.Reset()
+	table.SetLogger(nil)
+	table.Add(k+"_3", 0, v)
+	if buf.Len() != 0 {
+		t.Error("Expected no log output without a logger, got", buf.String())
+	}
+}
+
+func TestTypedTable(t *testing.T) {
+	counters := NewTypedTable[string, int](Cache("testTypedTableStrings", false))
+	counters.Add(k, 0, 42)
+	if n, err := counters.Value(k); err != nil || n != 42 {
+		t.Error("Error retrieving typed value:", n, err)
+	}
+	if _, err := counters.Value(k + "_missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+	counters.Table().Add(k+"_untyped", 0, v)
+	if _, err := counters.Value(k + "_untyped"); err != ErrTypeMismatch {
+		t.Error("Expected ErrTypeMismatch, got", err)
+	}
+
+	blobs := NewTypedTable[int, []byte](Cache("testTypedTableBytes", false))
+	blobs.Add(1, 0, []byte(v))
+	if b, err := blobs.Value(1); err != nil || string(b) != v {
+		t.Error("Error retrieving typed value:", b, err)
+	}
+	if err := blobs.Delete(1); err != nil || blobs.Exists(1) {
+		t.Error("Error deleting typed value:", err)
+	}
+}
+
+func TestGetOrAdd(t *testing.T) {
+	table := Cache("testGetOrAdd", false)
+	var created int32
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := make(map[*CacheItem]int)
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item, _ := table.GetOrAdd(k, 0, func() interface{} {
+				atomic.AddInt32(&created, 1)
+				time.Sleep(time.Millisecond)
+				return v
+			})
+			mu.Lock()
+			results[item]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Error("Expected create to run once, ran", created, "times")
+	}
+	if len(results) != 1 {
+		t.Error("Expected all callers to get the same item")
+	}
+	if _, isNew := table.GetOrAdd(k, 0, func() interface{} { return v }); isNew {
+		t.Error("Expected existing item to be returned")
+	}
+}
+
+func TestNotFoundAdd(t *testing.T) {
+	table := Cache("testNotFoundAdd", false)
+	var added int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if table.NotFoundAdd(k, 0, i) {
+				atomic.AddInt32(&added, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if added != 1 {
+		t.Error("Expected exactly one caller to add the item, got", added)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	table := Cache("testIncrement", false)
+	if n, err := table.Increment(k, 5, 0); err != nil || n != 5 {
+		t.Error("Expected first increment to create the item:", n, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := table.Increment(k, 1, 0); err != nil {
+				t.Error("Error incrementing:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	p, err := table.Value(k)
+	if err != nil || p.Data().(int64) != 105 {
+		t.Error("Expected concurrent increments to sum up to 105, got", p.Data())
+	}
+
+	table.Add(k+"_string", 0, v)
+	if _, err := table.Increment(k+"_string", 1, 0); err != ErrTypeMismatch {
+		t.Error("Expected ErrTypeMismatch, got", err)
+	}
+}
+
+func TestAddBatch(t *testing.T) {
+	table := Cache("testAddBatch", false)
+	added := 0
+	table.SetAddedItemCallback(func(item *CacheItem) {
+		added++
+	})
+
+	items := make(map[interface{}]interface{})
+	for i := 0; i < 100; i++ {
+		items[k+strconv.Itoa(i)] = i
+	}
+	table.AddBatch(items, 50*time.Millisecond)
+
+	if table.Count() != len(items) || added != len(items) {
+		t.Error("Expected", len(items), "items and callbacks, got", table.Count(), added)
+	}
+	for key, data := range items {
+		p, err := table.Value(key)
+		if err != nil || p.Data() != data {
+			t.Error("Error retrieving batch-added item", key)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if table.Count() != 0 {
+		t.Error("Expected batch-added items to expire")
+	}
+}
+
+func BenchmarkAddBatch(b *testing.B) {
+	items := make(map[interface{}]interface{})
+	for i := 0; i < 1000; i++ {
+		items[k+strconv.Itoa(i)] = v
+	}
+	table := Cache("benchmarkAddBatch", false)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.AddBatch(items, 0)
+	}
+}
+
+func BenchmarkAddLoop(b *testing.B) {
+	items := make(map[interface{}]interface{})
+	for i := 0; i < 1000; i++ {
+		items[k+strconv.Itoa(i)] = v
+	}
+	table := Cache("benchmarkAddLoop", false)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for key, data := range items {
+			table.Add(key, 0, data)
+		}
+	}
+}
+
+func TestValueBatch(t *testing.T) {
+	table := Cache("testValueBatch", false)
+	table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+
+	found, missing := table.ValueBatch([]interface{}{k + "_1", k + "_missing", k + "_2"})
+	if len(found) != 2 || found[k+"_1"] == nil || found[k+"_2"] == nil {
+		t.Error("Expected two items to be found, got", found)
+	}
+	if len(missing) != 1 || missing[0] != k+"_missing" {
+		t.Error("Expected one missing key, got", missing)
+	}
+	if found[k+"_1"].AccessCount() != 1 {
+		t.Error("Expected found items to be kept alive")
+	}
+}
+
+func BenchmarkValueBatch(b *testing.B) {
+	table := Cache("benchmarkValueBatch", false)
+	keys := make([]interface{}, 50)
+	for i := range keys {
+		keys[i] = k + strconv.Itoa(i)
+		table.Add(keys[i], 0, v)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.ValueBatch(keys)
+	}
+}
+
+func BenchmarkValueLoop(b *testing.B) {
+	table := Cache("benchmarkValueLoop", false)
+	keys := make([]interface{}, 50)
+	for i := range keys {
+		keys[i] = k + strconv.Itoa(i)
+		table.Add(keys[i], 0, v)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			_, _ = table.Value(key)
+		}
+	}
+}
+
+func TestSetLifeSpan(t *testing.T) {
+	table := Cache("testSetLifeSpan", true)
+	table.Add(k, 100*time.Millisecond, v)
+	if err := table.SetLifeSpan(k+"_missing", time.Second); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := table.SetLifeSpan(k, 150*time.Millisecond); err != nil {
+		t.Error("Error setting lifespan:", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Item expired despite its extended lifespan")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item should have expired after its extended lifespan")
+	}
+
+	// Shortening the lifespan must re-schedule the expiration check.
+	table.Add(k, time.Hour, v)
+	if err := table.SetLifeSpan(k, 50*time.Millisecond); err != nil {
+		t.Error("Error setting lifespan:", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Item should have expired after its shortened lifespan")
+	}
+}
+
+func TestNeverExpire(t *testing.T) {
+	table := Cache("testNeverExpire", true)
+	table.Add(k, 0, v)
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), 30*time.Millisecond, v)
+		time.Sleep(60 * time.Millisecond)
+	}
+
+	if table.Count() != 1 {
+		t.Error("Expected only the never-expiring item to remain, got", table.Count())
+	}
+	if _, err := table.Value(k); err != nil {
+		t.Error("Never-expiring item got removed:", err)
+	}
+}
+
+func TestSaveAndLoadFromFile(t *testing.T) {
+	table := Cache("testSaveAndLoadFromFile", false)
+	table.Add(k+"_forever", 0, v)
+	table.Add(k+"_long", time.Minute, 42)
+	table.Add(k+"_short", 50*time.Millisecond, v)
+	expiresAt := time.Now().Add(time.Hour).Round(0)
+	table.AddWithExpiry(k+"_absolute", expiresAt, v)
+	table.AddWithPolicy(k+"_sliding", time.Minute, v, ExpireSliding)
+	table.AddWithPriority(k+"_priority", 0, v, 7)
+
+	path := filepath.Join(t.TempDir(), "table.gob")
+	if err := table.SaveToFile(path); err != nil {
+		t.Fatal("Error saving table:", err)
+	}
+	table.Flush()
+
+	// Let the short-lived item expire while the table is "down".
+	time.Sleep(100 * time.Millisecond)
+	if err := table.LoadFromFile(path); err != nil {
+		t.Fatal("Error loading table:", err)
+	}
+
+	if table.Count() != 5 || table.Exists(k+"_short") {
+		t.Error("Expected expired item to be skipped, got", table.Count(), "items")
+	}
+	p, err := table.Value(k + "_forever")
+	if err != nil || p.Data().(string) != v || p.LifeSpan() != 0 {
+		t.Error("Error restoring never-expiring item")
+	}
+	if ttl, _ := table.TTL(k + "_long"); ttl > time.Minute-100*time.Millisecond || ttl < 50*time.Second {
+		t.Error("Expected restored item's remaining lifespan to be reduced, got", ttl)
+	}
+	p, err = table.Value(k + "_long")
+	if err != nil || p.Data().(int) != 42 {
+		t.Error("Error restoring item")
+	}
+	if p.LifeSpan() != time.Minute {
+		t.Error("Expected restored item to keep its lifespan, got", p.LifeSpan())
+	}
+	if p, err = table.Peek(k + "_absolute"); err != nil || !p.ExpiresAt().Equal(expiresAt) {
+		t.Error("Expected restored item to keep its absolute expiry, got", p, err)
+	}
+	if p, err = table.Peek(k + "_sliding"); err != nil || p.Policy() != ExpireSliding {
+		t.Error("Expected restored item to keep its policy, got", p, err)
+	}
+	if p, err = table.Peek(k + "_priority"); err != nil || p.Priority() != 7 {
+		t.Error("Expected restored item to keep its priority, got", p, err)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	table := Cache("testMarshalJSON", false)
+	item := table.Add(k, time.Minute, v)
+	table.Add(1.5, 0, 42)
+	table.Add(complex(1, 2), 0, v)
+
+	b, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal("Error marshaling table:", err)
+	}
+
+	var snapshot struct {
+		Name  string
+		Items []struct {
+			Key       interface{}
+			Value     interface{}
+			CreatedOn time.Time
+			LifeSpan  time.Duration
+		}
+	}
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		t.Fatal("Error unmarshaling snapshot:", err)
+	}
+	if snapshot.Name != "testMarshalJSON" || len(snapshot.Items) != 3 {
+		t.Fatal("Unexpected snapshot:", string(b))
+	}
+	for _, i := range snapshot.Items {
+		switch i.Key {
+		case k:
+			if i.Value != v || i.LifeSpan != time.Minute || !i.CreatedOn.Equal(item.CreatedOn()) {
+				t.Error("Unexpected snapshot of item:", i)
+			}
+		case 1.5:
+			if i.Value != 42.0 || i.LifeSpan != 0 {
+				t.Error("Unexpected snapshot of item:", i)
+			}
+		case "(1+2i)":
+		default:
+			t.Error("Unexpected key in snapshot:", i.Key)
+		}
+	}
+}
+
+func TestMaxItems(t *testing.T) {
+	table := Cache("testMaxItems", false)
+	table.SetMaxItems(3)
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+		time.Sleep(time.Millisecond)
+	}
+
+	// Access the oldest item, so the second one becomes least recently used.
+	_, _ = table.Value(k + "0")
+	time.Sleep(time.Millisecond)
+	table.Add(k+"3", 0, v)
+
+	if table.Count() != 3 {
+		t.Error("Expected table to hold 3 items, got", table.Count())
+	}
+	if table.Exists(k+"1") || !table.Exists(k+"0") || !table.Exists(k+"2") || !table.Exists(k+"3") {
+		t.Error("Expected least recently accessed item to be evicted")
+	}
+
+	// Lowering the limit evicts items right away.
+	table.SetMaxItems(1)
+	if table.Count() != 1 || !table.Exists(k+"3") {
+		t.Error("Expected only the most recently accessed item to remain")
+	}
+
+	// Keeping an item alive directly counts as an access as well.
+	table.SetMaxItems(2)
+	table.Add(k+"4", 0, v)
+	if item, err := table.Peek(k + "3"); err == nil {
+		item.KeepAlive()
+	}
+	table.Add(k+"5", 0, v)
+	if table.Exists(k+"4") || !table.Exists(k+"3") || !table.Exists(k+"5") {
+		t.Error("Expected the item kept alive to survive")
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	table := Cache("testMaxBytes", false)
+	table.SetMaxBytes(100, func(item *CacheItem) int64 {
+		return int64(len(item.Data().(string)))
+	})
+
+	data := strings.Repeat("x", 30)
+	for i := 0; i < 10; i++ {
+		table.Add(k+strconv.Itoa(i), 0, data)
+		if table.Bytes() > 100 {
+			t.Error("Table exceeds its size limit:", table.Bytes())
+		}
+	}
+	if table.Count() != 3 || table.Bytes() != 90 {
+		t.Error("Expected 3 items of 90 bytes in total, got", table.Count(), table.Bytes())
+	}
+	if !table.Exists(k+"9") || table.Exists(k+"0") {
+		t.Error("Expected least recently added items to be evicted")
+	}
+
+	// Replacing and deleting items updates the total size.
+	table.Add(k+"9", 0, "x")
+	if table.Bytes() != 61 {
+		t.Error("Expected 61 bytes after replacing an item, got", table.Bytes())
+	}
+	if _, err := table.Delete(k + "9"); err != nil || table.Bytes() != 60 {
+		t.Error("Expected 60 bytes after deleting an item, got", table.Bytes())
+	}
+	table.Flush()
+	if table.Bytes() != 0 {
+		t.Error("Expected 0 bytes after flushing, got", table.Bytes())
+	}
+}
+
+func TestTTL(t *testing.T) {
+	table := Cache("testTTL", true)
+	table.Add(k+"_fresh", time.Minute, v)
+	table.Add(k+"_expiring", 100*time.Millisecond, v)
+	table.Add(k+"_forever", 0, v)
+
+	if ttl, err := table.TTL(k + "_fresh"); err != nil || ttl > time.Minute || ttl < 59*time.Second {
+		t.Error("Unexpected TTL for fresh item:", ttl, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if ttl, err := table.TTL(k + "_expiring"); err != nil || ttl > 40*time.Millisecond {
+		t.Error("Unexpected TTL for nearly expired item:", ttl, err)
+	}
+	if ttl, err := table.TTL(k + "_forever"); err != nil || ttl != -1 {
+		t.Error("Unexpected TTL for never-expiring item:", ttl, err)
+	}
+	if _, err := table.TTL(k + "_missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	table := Cache("testKeys", false)
+	expected := make(map[interface{}]bool)
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, v)
+		expected[i] = true
+	}
+
+	keys := table.Keys()
+	if len(keys) != len(expected) {
+		t.Error("Expected", len(expected), "keys, got", len(keys))
+	}
+	for _, key := range keys {
+		if !expected[key] {
+			t.Error("Unexpected key", key)
+		}
+		delete(expected, key)
+	}
+}
+
+func TestMostAccessed(t *testing.T) {
+	table := Cache("testMostAccessed", false)
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, v)
+		for j := 0; j < i; j++ {
+			_, _ = table.Value(i)
+		}
+	}
+
+	items := table.MostAccessed(3)
+	if len(items) != 3 {
+		t.Fatal("Expected 3 items, got", len(items))
+	}
+	for i, item := range items {
+		if item.Key() != 4-i {
+			t.Error("Expected key", 4-i, "at position", i, "got", item.Key())
+		}
+	}
+	if len(table.MostAccessed(10)) != 5 {
+		t.Error("Expected all items when requesting more than available")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	table := Cache("testTouch", true)
+	table.Add(k, 100*time.Millisecond, v)
+	if err := table.Touch(k + "_missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := table.Touch(k); err != nil {
+		t.Error("Error touching item:", err)
+	}
+	time.Sleep(70 * time.Millisecond)
+	p, err := table.Value(k)
+	if err != nil {
+		t.Fatal("Touched item expired too early")
+	}
+	if p.LifeSpan() != 100*time.Millisecond {
+		t.Error("Touching changed the item's lifespan")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if table.Exists(k) {
+		t.Error("Touched item should have expired")
+	}
+}
+
+func TestValueCtx(t *testing.T) {
+	table := Cache("testValueCtx", false)
+	release := make(chan struct{})
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		<-release
+		return NewCacheItem(key, 0, v)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := table.ValueCtx(ctx, k); err != context.Canceled {
+		t.Error("Expected context.Canceled, got", err)
+	}
+	if _, err := table.ValueCtx(ctx, k); err != context.Canceled {
+		t.Error("Expected context.Canceled for a done context, got", err)
+	}
+
+	// The abandoned load still populates the cache once it finishes.
+	close(release)
+	time.Sleep(20 * time.Millisecond)
+	if p, err := table.ValueCtx(context.Background(), k); err != nil || p.Data().(string) != v {
+		t.Error("Expected item loaded in the background to be cached:", err)
+	}
+}
+
+func TestCloneOnRead(t *testing.T) {
+	table := Cache("testCloneOnRead", false)
+	table.Add(k, 0, []int{1, 2, 3})
+	table.SetCloneOnRead(func(data interface{}) interface{} {
+		return append([]int(nil), data.([]int)...)
+	})
+
+	p, err := table.Value(k)
+	if err != nil {
+		t.Fatal("Error retrieving data:", err)
+	}
+	p.Data().([]int)[0] = 42
+
+	p, err = table.Value(k)
+	if err != nil || p.Data().([]int)[0] != 1 {
+		t.Error("Modifying returned data changed the cached item")
+	}
+	if p.AccessCount() != 2 {
+		t.Error("Expected copy to carry the item's access count, got", p.AccessCount())
+	}
+
+	table.SetCloneOnRead(nil)
+	p, _ = table.Value(k)
+	p.Data().([]int)[0] = 42
+	if p, _ = table.Value(k); p.Data().([]int)[0] != 42 {
+		t.Error("Expected cached item to be returned without clone callback")
+	}
+}
+
+func TestUpdateData(t *testing.T) {
+	table := Cache("testUpdateData", true)
+	item := table.Add(k, time.Minute, v)
+	time.Sleep(10 * time.Millisecond)
+	ttl, _ := table.TTL(k)
+
+	if err := table.UpdateData(k, 42); err != nil {
+		t.Error("Error updating data:", err)
+	}
+	if err := table.UpdateData(k+"_missing", 42); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+
+	p, err := table.Value(k)
+	if err != nil || p != item || p.Data().(int) != 42 {
+		t.Error("Expected data of existing item to be replaced")
+	}
+	if p.LifeSpan() != time.Minute {
+		t.Error("Updating data changed the item's lifespan")
+	}
+	if newTTL, _ := table.TTL(k); newTTL > ttl {
+		t.Error("Updating data restarted the item's expiration clock")
+	}
+}
+
+func TestCacheItemGetters(t *testing.T) {
+	before := time.Now()
+	item := NewCacheItem(k, time.Minute, v)
+
+	if item.Key() != k || item.Data() != v || item.LifeSpan() != time.Minute {
+		t.Error("Getters don't return the values passed to NewCacheItem")
+	}
+	if item.CreatedOn().Before(before) || !item.AccessedOn().Equal(item.CreatedOn()) {
+		t.Error("Unexpected timestamps on new item")
+	}
+	if item.AccessCount() != 0 {
+		t.Error("Expected new item to not have been accessed yet")
+	}
+
+	item.KeepAlive()
+	if item.AccessCount() != 1 || !item.AccessedOn().After(item.CreatedOn()) {
+		t.Error("Expected KeepAlive to update access count and timestamp")
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	table := Cache("testDeleteBatch", false)
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, v)
+	}
+
+	if deleted := table.DeleteBatch([]interface{}{0, 2, 4, 6, 8}); deleted != 3 {
+		t.Error("Expected 3 deleted items, got", deleted)
+	}
+	if table.Count() != 2 || !table.Exists(1) || !table.Exists(3) {
+		t.Error("Expected only items not in the batch to remain")
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	table := Cache("testDeleteFunc", false)
+	for i := 0; i < 5; i++ {
+		table.Add("tenant:1:"+strconv.Itoa(i), 0, v)
+		table.Add("tenant:2:"+strconv.Itoa(i), 0, v)
+	}
+
+	deleted := table.DeleteFunc(func(key interface{}, item *CacheItem) bool {
+		return strings.HasPrefix(key.(string), "tenant:1:")
+	})
+	if deleted != 5 || table.Count() != 5 {
+		t.Error("Expected 5 of 10 items to be deleted, got", deleted)
+	}
+	for _, key := range table.Keys() {
+		if !strings.HasPrefix(key.(string), "tenant:2:") {
+			t.Error("Unexpected remaining key", key)
+		}
+	}
+}
+
+func TestCleanupCallback(t *testing.T) {
+	table := Cache("testCleanupCallback", false)
+	var removed int32
+	table.SetCleanupCallback(func(n int, duration time.Duration) {
+		if duration < 0 {
+			t.Error("Unexpected expiration check duration", duration)
+		}
+		atomic.AddInt32(&removed, int32(n))
+	})
+
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), 50*time.Millisecond, v)
+	}
+	table.Add(k, 0, v)
+	time.Sleep(150 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&removed); n != 3 {
+		t.Error("Expected cleanup callback to report 3 removed items, got", n)
+	}
+}
+
+func TestDataLoadedCallback(t *testing.T) {
+	table := Cache("testDataLoadedCallback", false)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, v)
+	})
+	var loaded []interface{}
+	table.SetDataLoadedCallback(func(item *CacheItem) {
+		loaded = append(loaded, item.Key())
+	})
+
+	table.Add(k+"_added", 0, v)
+	_, _ = table.Value(k + "_added")
+	_, _ = table.Value(k + "_loaded")
+	_, _ = table.Value(k + "_loaded")
+
+	if len(loaded) != 1 || loaded[0] != k+"_loaded" {
+		t.Error("Expected callback only for the loaded item, got", loaded)
+	}
+}
+
+func TestKeyNotFoundError(t *testing.T) {
+	table := Cache("testKeyNotFoundError", false)
+	_, err := table.Value(k)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected error to match ErrKeyNotFound, got", err)
+	}
+
+	var knf *KeyNotFoundError
+	if !errors.As(err, &knf) || knf.Key != k {
+		t.Error("Expected missing key to be recoverable from error, got", err)
+	}
+	if err.Error() != "Key not found in cache: "+k {
+		t.Error("Unexpected error message:", err)
+	}
+
+	if _, err := table.Delete(k); !errors.As(err, &knf) || knf.Key != k {
+		t.Error("Expected Delete to return a KeyNotFoundError, got", err)
+	}
+	if err := table.SetLifeSpan(k, 0); !errors.As(err, &knf) || knf.Key != k {
+		t.Error("Expected SetLifeSpan to return a KeyNotFoundError, got", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	table := Cache("testClone", true)
+	item := table.Add(k+"_1", time.Minute, v)
+	table.Add(k+"_2", 0, v)
+	_, _ = table.Value(k + "_1")
+	expired := table.Add(k+"_expired", time.Minute, v)
+	expired.Lock()
+	expired.createdOn = expired.createdOn.Add(-time.Hour)
+	expired.Unlock()
+
+	if _, err := table.Clone("testClone"); !errors.Is(err, ErrTableExists) {
+		t.Error("Expected cloning onto an existing table to fail, got", err)
+	}
+	clone, err := table.Clone("testCloneCopy")
+	if err != nil || clone == table || Cache("testCloneCopy", true) != clone {
+		t.Fatal("Expected clone to be a new registered table, got", err)
+	}
+	if clone.Exists(k + "_expired") {
+		t.Error("Expected expired item not to be cloned")
+	}
+	_, _ = table.Delete(k + "_expired")
+	p, err := clone.Value(k + "_1")
+	if err != nil || p == item || p.Data() != v {
+		t.Fatal("Expected clone to hold a copy of the item")
+	}
+	if !p.CreatedOn().Equal(item.CreatedOn()) || p.LifeSpan() != time.Minute || p.AccessCount() != 2 {
+		t.Error("Expected copied item to keep its metadata")
+	}
+
+	clone.Add(k+"_3", 0, v)
+	if _, err := clone.Delete(k + "_2"); err != nil {
+		t.Error("Error deleting from clone:", err)
+	}
+	if err := clone.UpdateData(k+"_1", 42); err != nil {
+		t.Error("Error updating clone:", err)
+	}
+	if table.Count() != 2 || table.Exists(k+"_3") || !table.Exists(k+"_2") || item.Data() != v {
+		t.Error("Modifying the clone affected the original table")
+	}
+}
+
+func TestValueOrLoad(t *testing.T) {
+	table := Cache("testValueOrLoad", false)
+	var slowLoads, fastLoads int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := table.ValueOrLoad(k+"_slow", 0, func() (interface{}, error) {
+				atomic.AddInt32(&slowLoads, 1)
+				<-release
+				return v, nil
+			})
+			if err != nil || p.Data() != v {
+				t.Error("Error loading slow item:", err)
+			}
+		}()
+	}
+
+	// Loading another key must not wait for the slow load.
+	time.Sleep(20 * time.Millisecond)
+	p, err := table.ValueOrLoad(k+"_fast", 0, func() (interface{}, error) {
+		atomic.AddInt32(&fastLoads, 1)
+		return v, nil
+	})
+	if err != nil || p.Data() != v {
+		t.Error("Error loading fast item:", err)
+	}
+
+	close(release)
+	wg.Wait()
+	if slowLoads != 1 || fastLoads != 1 {
+		t.Error("Expected a single load per key, got", slowLoads, fastLoads)
+	}
+	if hits, misses, _ := table.Stats(); hits+misses != 51 || misses < 2 {
+		t.Error("Expected one hit or miss per call, got", hits, misses)
+	}
+
+	// Errors are returned but not cached.
+	loadErr := errors.New("load failed")
+	if _, err := table.ValueOrLoad(k+"_failing", 0, func() (interface{}, error) {
+		return nil, loadErr
+	}); err != loadErr || table.Exists(k+"_failing") {
+		t.Error("Expected load error to be returned and not cached, got", err)
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	table := Cache("testNegativeTTL", false)
+	defer table.Stop()
+	loads := 0
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		loads++
+		return nil
+	})
+	table.SetNegativeTTL(50 * time.Millisecond)
+
+	if _, err := table.Value(k); err != ErrKeyNotFoundOrLoadable {
+		t.Error("Expected ErrKeyNotFoundOrLoadable, got", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := table.Value(k); err != ErrNegativeCached {
+			t.Error("Expected ErrNegativeCached, got", err)
+		}
+	}
+	if loads != 1 {
+		t.Error("Expected data-loader to run once, ran", loads, "times")
+	}
+	if hits, misses, _ := table.Stats(); hits != 0 || misses != 4 {
+		t.Error("Expected negative lookups to count as misses, got", hits, misses)
+	}
+
+	// Everything else treats the remembered key as absent.
+	if table.Exists(k) || table.Count() != 0 || len(table.Keys()) != 0 {
+		t.Error("Expected negative entry to be invisible")
+	}
+	if _, missing := table.ValueBatch([]interface{}{k}); len(missing) != 1 {
+		t.Error("Expected ValueBatch to miss the negative entry")
+	}
+	if _, err := table.Peek(k); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected Peek to return ErrKeyNotFound, got", err)
+	}
+	if clone, err := table.Clone("testNegativeTTLClone"); err != nil || clone.Count() != 0 {
+		t.Error("Expected Clone to skip the negative entry, got", err)
+	} else {
+		clone.Stop()
+	}
+	if item, err := table.ValueOrLoad(k, 0, func() (interface{}, error) {
+		return "loaded", nil
+	}); err != nil || item.Data() != "loaded" {
+		t.Error("Expected ValueOrLoad to call load, got", item, err)
+	}
+	if _, err := table.Value(k); err != nil {
+		t.Error("Expected added item to replace the negative entry, got", err)
+	}
+	if _, err := table.Delete(k); err != nil {
+		t.Error("Error deleting item:", err)
+	}
+
+	// Once the negative entry expires, the data-loader is tried again.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := table.Value(k); err != ErrKeyNotFoundOrLoadable || loads != 2 {
+		t.Error("Expected data-loader to run again, got", err, loads)
+	}
+	if _, created := table.GetOrAdd(k, 0, func() interface{} { return v }); !created {
+		t.Error("Expected GetOrAdd to create the item")
+	}
+	if _, err := table.Delete(k); err != nil {
+		t.Error("Error deleting item:", err)
+	}
+	if _, err := table.Value(k); err != ErrKeyNotFoundOrLoadable {
+		t.Error("Expected ErrKeyNotFoundOrLoadable, got", err)
+	}
+	if !table.NotFoundAdd(k, 0, v) {
+		t.Error("Expected NotFoundAdd to add the item")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	table := Cache("testCompareAndSwap", false)
+	table.Add(k, 0, []int{0})
+	if _, err := table.CompareAndSwap(k+"_missing", nil, nil, 0); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+
+	var swapped int32
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := table.CompareAndSwap(k, []int{0}, []int{i}, time.Minute)
+			if err != nil {
+				t.Error("Error swapping:", err)
+			}
+			if ok {
+				atomic.AddInt32(&swapped, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if swapped != 1 {
+		t.Error("Expected exactly one swap to succeed, got", swapped)
+	}
+	p, _ := table.Value(k)
+	if p.Data().([]int)[0] == 0 || p.LifeSpan() != time.Minute {
+		t.Error("Expected successful swap to replace data and lifespan")
+	}
+}
+
+func TestDeleteConcurrently(t *testing.T) {
+	table := Cache("testDeleteConcurrently", false)
+	table.SetAboutToDeleteItemCallback(func(item *CacheItem) {
+		// Keep the table unlocked for a while, as a slow callback would.
+		time.Sleep(10 * time.Millisecond)
+	})
+	table.Add(k, 0, v)
+
+	var deleted int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p, err := table.Delete(k); err == nil && p.Data() == v {
+				atomic.AddInt32(&deleted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if deleted != 1 {
+		t.Error("Expected exactly one delete to succeed, got", deleted)
+	}
+}
+
+func TestReapNow(t *testing.T) {
+	table := Cache("testReapNow", false)
+	table.Add(k, 0, v)
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), time.Minute, v)
+	}
+	if removed := table.ReapNow(); removed != 0 {
+		t.Error("Expected nothing to be reaped, got", removed)
+	}
+
+	// Let the items expire without waiting for the timer.
+	table.Foreach(func(key interface{}, item *CacheItem) {
+		item.Lock()
+		item.accessedOn = item.accessedOn.Add(-time.Hour)
+		item.Unlock()
+	})
+	if removed := table.ReapNow(); removed != 3 || table.Count() != 1 {
+		t.Error("Expected 3 items to be reaped, got", removed)
+	}
+}
+
+func TestAccessCallback(t *testing.T) {
+	table := Cache("testAccessCallback", true)
+	var tableAccesses int32
+	table.AddAccessCallback(func(item *CacheItem) {
+		atomic.AddInt32(&tableAccesses, 1)
+	})
+
+	// Extend the item's lifespan once it turned out to be popular.
+	item := table.Add(k, 100*time.Millisecond, v)
+	item.AddAccessCallback(func(item *CacheItem) {
+		if item.AccessCount() == 3 {
+			if err := table.SetLifeSpan(item.Key(), time.Minute); err != nil {
+				t.Error("Error extending lifespan:", err)
+			}
+		}
+	})
+	table.Add(k+"_other", 0, v)
+
+	for i := 0; i < 3; i++ {
+		_, _ = table.Value(k)
+	}
+	_, _ = table.Value(k + "_other")
+	_, _ = table.Value(k + "_missing")
+
+	if n := atomic.LoadInt32(&tableAccesses); n != 4 {
+		t.Error("Expected 4 table access callbacks, got", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !table.Exists(k) {
+		t.Error("Expected item to survive after its lifespan got extended")
+	}
+}
+
+func TestForeachN(t *testing.T) {
+	table := Cache("testForeachN", false)
+	for i := 0; i < 10; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+	}
+
+	// The visit budget caps the iteration.
+	visited := table.ForeachN(4, func(key interface{}, item *CacheItem) bool {
+		return true
+	})
+	if visited != 4 {
+		t.Error("Expected ForeachN to visit 4 items, got", visited)
+	}
+
+	// Returning false stops the iteration early.
+	calls := 0
+	visited = table.ForeachN(8, func(key interface{}, item *CacheItem) bool {
+		calls++
+		return calls < 3
+	})
+	if visited != 3 || calls != 3 {
+		t.Error("Expected ForeachN to stop after 3 items, got", visited, calls)
+	}
+
+	// A budget larger than the table visits every item.
+	visited = table.ForeachN(100, func(key interface{}, item *CacheItem) bool {
+		return true
+	})
+	if visited != 10 {
+		t.Error("Expected ForeachN to visit all 10 items, got", visited)
+	}
+}
+
+func TestRenameTable(t *testing.T) {
+	table := Cache("testRenameTable-v2", false)
+	table.Add(k, 0, v)
+
+	Cache("testRenameTable", false)
+	if err := RenameTable(context.Background(), "testRenameTable-v2", "testRenameTable"); !errors.Is(err, ErrTableExists) {
+		t.Error("Expected renaming onto an existing table to fail, got", err)
+	}
+	if err := RenameTable(context.Background(), "testRenameTable-missing", "testRenameTable-v3"); !errors.Is(err, ErrTableNotFound) {
+		t.Error("Expected renaming a missing table to fail, got", err)
+	}
+
+	if err := RenameTable(context.Background(), "testRenameTable-v2", "testRenameTable-v3"); err != nil {
+		t.Error("Error renaming table:", err)
+	}
+	if Cache("testRenameTable-v3", false) != table {
+		t.Error("Expected the renamed table to be returned under its new name")
+	}
+	if table.Name() != "testRenameTable-v3" {
+		t.Error("Expected the table name to be updated, got", table.Name())
+	}
+	if !table.Exists(k) {
+		t.Error("Expected items to survive the rename")
+	}
+	if Cache("testRenameTable-v2", false) == table {
+		t.Error("Expected the old name to no longer refer to the renamed table")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := RenameTable(ctx, "testRenameTable-v3", "testRenameTable-v4"); !errors.Is(err, context.Canceled) {
+		t.Error("Expected a canceled context to abort the rename, got", err)
+	}
+}
+
+func TestTablesAndDropTable(t *testing.T) {
+	names := []string{"testDropTable1", "testDropTable2", "testDropTable3"}
+	for _, name := range names {
+		Cache(name, false).Add(k, 0, v)
+	}
+
+	contains := func(name string) bool {
+		for _, n := range Tables() {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range names {
+		if !contains(name) {
+			t.Error("Expected Tables to list", name)
+		}
+	}
+
+	dropped := Cache("testDropTable2", false)
+	if err := DropTable("testDropTable2"); err != nil {
+		t.Error("Error dropping table:", err)
+	}
+	if contains("testDropTable2") {
+		t.Error("Expected dropped table to be gone from Tables")
+	}
+	if dropped.Count() != 0 {
+		t.Error("Expected dropped table to be flushed")
+	}
+	if !contains("testDropTable1") || !contains("testDropTable3") {
+		t.Error("Expected other tables to be unaffected")
+	}
+	if err := DropTable("testDropTable2"); !errors.Is(err, ErrTableNotFound) {
+		t.Error("Expected dropping a missing table to fail, got", err)
+	}
+}
+
+func TestCleanupJitter(t *testing.T) {
+	const tables = 8
+	var mu sync.Mutex
+	var fired []time.Time
+
+	var wg sync.WaitGroup
+	wg.Add(tables)
+	for i := 0; i < tables; i++ {
+		table := Cache("testCleanupJitter"+strconv.Itoa(i), true)
+		table.SetCleanupJitter(1)
+		var once sync.Once
+		table.SetCleanupCallback(func(removed int, duration time.Duration) {
+			if removed == 0 {
+				return
+			}
+			once.Do(func() {
+				mu.Lock()
+				fired = append(fired, time.Now())
+				mu.Unlock()
+				wg.Done()
+			})
+		})
+	}
+	for i := 0; i < tables; i++ {
+		Cache("testCleanupJitter"+strconv.Itoa(i), true).Add(k, 50*time.Millisecond, v)
+	}
+	wg.Wait()
+
+	first, last := fired[0], fired[0]
+	for _, f := range fired {
+		if f.Before(first) {
+			first = f
+		}
+		if f.After(last) {
+			last = f
+		}
+	}
+	if last.Sub(first) < 5*time.Millisecond {
+		t.Error("Expected cleanup runs to be staggered, got a spread of", last.Sub(first))
+	}
+}
+
+func TestValueOrDefault(t *testing.T) {
+	table := Cache("testValueOrDefault", false)
+	table.Add(k, 0, v)
+
+	if d := table.ValueOrDefault(k, "fallback"); d != v {
+		t.Error("Expected stored value on hit, got", d)
+	}
+	if d := table.ValueOrDefault(k+"_missing", "fallback"); d != "fallback" {
+		t.Error("Expected default value on miss, got", d)
+	}
+	if _, misses, _ := table.Stats(); misses != 1 {
+		t.Error("Expected the miss to be counted, got", misses)
+	}
+}
+
+func TestAddWithPriority(t *testing.T) {
+	var heap uint64
+	defer func(f func() uint64) { heapAlloc = f }(heapAlloc)
+	heapAlloc = func() uint64 { return atomic.LoadUint64(&heap) }
+
+	table := Cache("testAddWithPriority", false)
+	table.SetHeapThreshold(1 << 20)
+	for i := 0; i < 3; i++ {
+		table.AddWithPriority("low"+strconv.Itoa(i), 0, v, 0)
+		table.AddWithPriority("high"+strconv.Itoa(i), 0, v, 10)
+	}
+	if table.Count() != 6 {
+		t.Error("Expected no evictions below the heap threshold, got", table.Count())
+	}
+
+	// Simulate memory pressure, the heap gets checked once per add.
+	atomic.StoreUint64(&heap, 2<<20)
+	for i := 3; i < 6; i++ {
+		table.Lock()
+		table.lastHeapCheck = time.Time{}
+		table.Unlock()
+		table.AddWithPriority("high"+strconv.Itoa(i), 0, v, 10)
+	}
+	for i := 0; i < 3; i++ {
+		if table.Exists("low" + strconv.Itoa(i)) {
+			t.Error("Expected low priority item to be evicted first")
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if !table.Exists("high" + strconv.Itoa(i)) {
+			t.Error("Expected high priority item to survive")
+		}
+	}
+
+	// Item limits evict lower priorities first as well.
+	atomic.StoreUint64(&heap, 0)
+	table.Flush()
+	table.SetMaxItems(2)
+	table.AddWithPriority("high", 0, v, 10)
+	table.AddWithPriority("low", 0, v, 0)
+	table.AddWithPriority("mid", 0, v, 5)
+	if table.Exists("low") || !table.Exists("high") || !table.Exists("mid") {
+		t.Error("Expected the lowest priority item to be evicted")
+	}
+}
+
+func TestHeapThresholdSamePriority(t *testing.T) {
+	var heap uint64
+	defer func(f func() uint64) { heapAlloc = f }(heapAlloc)
+	heapAlloc = func() uint64 { return atomic.LoadUint64(&heap) }
+
+	table := Cache("testHeapThresholdSamePriority", false)
+	defer table.Stop()
+	table.SetHeapThreshold(1 << 20)
+	for i := 0; i < 20; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+	}
+	_, _ = table.Value(k + "0")
+
+	// Only a tenth of the items gets evicted, least recently accessed first.
+	atomic.StoreUint64(&heap, 2<<20)
+	table.Lock()
+	table.lastHeapCheck = time.Time{}
+	table.Unlock()
+	table.Add(k+"_new", 0, v)
+	if table.Count() != 19 {
+		t.Error("Expected 2 items to be evicted, got", 21-table.Count())
+	}
+	if table.Exists(k+"1") || table.Exists(k+"2") || !table.Exists(k+"0") || !table.Exists(k+"_new") {
+		t.Error("Expected the least recently accessed items to be evicted")
+	}
+
+	// The heap isn't checked again right away.
+	table.Add(k+"_newer", 0, v)
+	if table.Count() != 20 {
+		t.Error("Expected no evictions before the next heap check, got", table.Count())
+	}
+
+	// The item just added is never evicted, even if it's the only one.
+	table.Flush()
+	table.Lock()
+	table.lastHeapCheck = time.Time{}
+	table.Unlock()
+	table.Add(k, 0, v)
+	if !table.Exists(k) {
+		t.Error("Expected the item just added to be kept")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	table := Cache("testMetrics", false)
+	table.SetMaxItems(5)
+	for i := 0; i < 7; i++ {
+		table.Add(k+strconv.Itoa(i), 0, v)
+	}
+	for i := 2; i < 5; i++ {
+		_, _ = table.Value(k + strconv.Itoa(i))
+	}
+	_, _ = table.Value(k + "_missing")
+	_, _ = table.Delete(k + "2")
+	table.DeleteBatch([]interface{}{k + "3", k + "_missing"})
+
+	// Let one item expire without waiting for the timer.
+	item := table.Add(k+"_expiring", time.Minute, v)
+	item.Lock()
+	item.accessedOn = item.accessedOn.Add(-time.Hour)
+	item.Unlock()
+	table.ReapNow()
+
+	expected := Metrics{Hits: 3, Misses: 1, Adds: 8, Deletes: 2, Evictions: 2, Expirations: 1, Items: 3}
+	if m := table.Metrics(); m != expected {
+		t.Errorf("Expected metrics %+v, got %+v", expected, m)
+	}
+
+	table.ResetStats()
+	if m := table.Metrics(); m != (Metrics{Items: 3}) {
+		t.Errorf("Expected reset metrics, got %+v", m)
+	}
+}
+
+func TestVetoExpiration(t *testing.T) {
+	table := Cache("testVetoExpiration", true)
+	var vetoes int32
+	item := table.Add(k, time.Minute, v)
+	item.SetAboutToExpireCallback(func(key interface{}) bool {
+		// Keep the item alive for exactly one sweep.
+		return atomic.AddInt32(&vetoes, 1) == 1
+	})
+	table.Add(k+"_other", time.Minute, v)
+
+	// Let the items expire without waiting for the timer.
+	expire := func() {
+		table.Foreach(func(key interface{}, item *CacheItem) {
+			item.Lock()
+			item.createdOn = item.createdOn.Add(-time.Hour)
+			item.Unlock()
+		})
+	}
+
+	expire()
+	if removed := table.ReapNow(); removed != 1 {
+		t.Error("Expected only the item without a veto to expire, got", removed)
+	}
+	if !table.Exists(k) {
+		t.Error("Expected vetoing callback to keep the item alive")
+	}
+	if time.Since(item.CreatedOn()) > time.Second {
+		t.Error("Expected the vetoed item's lifespan to start over")
+	}
+	if ttl, err := table.TTL(k); err != nil || ttl <= 0 {
+		t.Error("Expected the vetoed item to be scheduled for expiration again, got", ttl, err)
+	}
+
+	expire()
+	if removed := table.ReapNow(); removed != 1 || table.Exists(k) {
+		t.Error("Expected the item to expire once the callback stops vetoing, got", removed)
+	}
+	if n := atomic.LoadInt32(&vetoes); n != 2 {
+		t.Error("Expected the callback to be consulted twice, got", n)
+	}
+
+	// Explicit deletes ignore the callback's decision.
+	item = table.Add(k, 0, v)
+	item.SetAboutToExpireCallback(func(key interface{}) bool {
+		return true
+	})
+	if _, err := table.Delete(k); err != nil || table.Exists(k) {
+		t.Error("Expected Delete to ignore the veto, got", err)
+	}
+}
+
+func TestWithInitialCapacity(t *testing.T) {
+	table := Cache("testWithInitialCapacity", false, WithInitialCapacity(100))
+	for i := 0; i < 200; i++ {
+		table.Add(i, 0, v)
+	}
+	if table.Count() != 200 {
+		t.Error("Expected 200 items, got", table.Count())
+	}
+
+	// Options don't apply to existing tables.
+	if Cache("testWithInitialCapacity", false, WithInitialCapacity(1)).Count() != 200 {
+		t.Error("Expected existing table to be returned unchanged")
+	}
+}
+
+func benchmarkInitialCapacity(b *testing.B, opts ...Option) {
+	const items = 100000
+	for i := 0; i < b.N; i++ {
+		table := Cache("benchmarkInitialCapacity", false, opts...)
+		for j := 0; j < items; j++ {
+			table.Add(j, 0, v)
+		}
+		table.Stop()
+	}
+}
+
+func BenchmarkLoadDefaultCapacity(b *testing.B) {
+	benchmarkInitialCapacity(b)
+}
+
+func BenchmarkLoadInitialCapacity(b *testing.B) {
+	benchmarkInitialCapacity(b, WithInitialCapacity(100000))
+}
+
+func TestOverwriteCallback(t *testing.T) {
+	table := Cache("testOverwriteCallback", false)
+	var calls int
+	var replaced, replacement *CacheItem
+	table.SetOverwriteCallback(func(old, new *CacheItem) {
+		calls++
+		replaced, replacement = old, new
+	})
+
+	first := table.Add(k, 0, v)
+	if first.Overwrote() || calls != 0 {
+		t.Error("Expected adding a new key not to overwrite anything")
+	}
+
+	second := table.Add(k, 0, v+"_new")
+	if !second.Overwrote() {
+		t.Error("Expected adding an existing key to report the overwrite")
+	}
+	if calls != 1 || replaced != first || replacement != second {
+		t.Error("Expected overwrite callback to receive the old and new item")
+	}
+	if replaced.Data() != v {
+		t.Error("Expected old item to keep its value, got", replaced.Data())
+	}
+}
+
+func TestWaitForKey(t *testing.T) {
+	table := Cache("testWaitForKey", false)
+	table.Add(k, 0, v)
+
+	// Existing items are returned right away.
+	if item, err := table.WaitForKey(context.Background(), k); err != nil || item.Data() != v {
+		t.Error("Expected existing item to be returned, got", item, err)
+	}
+
+	results := make(chan *CacheItem, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			item, err := table.WaitForKey(context.Background(), k+"_later")
+			if err != nil {
+				t.Error("Error waiting for key:", err)
+			}
+			results <- item
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	added := table.Add(k+"_later", 0, v)
+	for i := 0; i < 2; i++ {
+		select {
+		case item := <-results:
+			if item != added {
+				t.Error("Expected waiter to receive the added item")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Waiter was not woken up")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := table.WaitForKey(ctx, k+"_never"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected waiting to time out, got", err)
+	}
+	table.RLock()
+	waiters := len(table.waiters)
+	table.RUnlock()
+	if waiters != 0 {
+		t.Error("Expected timed out waiter to be unregistered")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	table := Cache("testWarmup", false)
+	keys := make([]interface{}, 20)
+	for i := range keys {
+		keys[i] = i
+	}
+
+	var running, maxRunning int32
+	load := func(key interface{}) (interface{}, time.Duration, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		if key.(int)%7 == 0 {
+			return nil, 0, errors.New("backend unavailable")
+		}
+		return key.(int) * 2, time.Minute, nil
+	}
+
+	err := table.Warmup(context.Background(), keys, 3, load)
+	var werr *WarmupError
+	if !errors.As(err, &werr) || len(werr.Errors) != 3 {
+		t.Error("Expected errors for keys 0, 7 and 14, got", err)
+	}
+	if table.Count() != 17 {
+		t.Error("Expected 17 loaded items, got", table.Count())
+	}
+	if item, err := table.Value(5); err != nil || item.Data() != 10 || item.LifeSpan() != time.Minute {
+		t.Error("Expected loaded item to be added, got", item, err)
+	}
+	if m := atomic.LoadInt32(&maxRunning); m > 3 {
+		t.Error("Expected at most 3 concurrent loads, got", m)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	table.Flush()
+	if err := table.Warmup(ctx, keys, 3, load); !errors.Is(err, context.Canceled) {
+		t.Error("Expected canceled warmup to fail, got", err)
+	}
+	if table.Count() != 0 {
+		t.Error("Expected canceled warmup not to load anything, got", table.Count())
+	}
+}
+
+func TestExpirationPolicy(t *testing.T) {
+	for _, expireByCreateTime := range []bool{false, true} {
+		table := Cache("testExpirationPolicy"+strconv.FormatBool(expireByCreateTime), expireByCreateTime)
+		table.AddWithPolicy("sliding", 100*time.Millisecond, v, ExpireSliding)
+		table.AddWithPolicy("absolute", 100*time.Millisecond, v, ExpireAbsolute)
+
+		// Keep accessing both items past their lifespan.
+		for i := 0; i < 6; i++ {
+			time.Sleep(30 * time.Millisecond)
+			_, _ = table.Value("sliding")
+			_, _ = table.Value("absolute")
+		}
+
+		if !table.Exists("sliding") {
+			t.Error("Expected accessed sliding item to be kept alive, expireByCreateTime:", expireByCreateTime)
+		}
+		if table.Exists("absolute") {
+			t.Error("Expected absolute item to expire despite accesses, expireByCreateTime:", expireByCreateTime)
+		}
+	}
+}
+
+func TestEstimateBytes(t *testing.T) {
+	table := Cache("testEstimateBytes", false)
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, v)
+	}
+
+	size := func(item *CacheItem) int64 { return 100 }
+	if n := table.EstimateBytes(size); n != 10*(100+itemOverhead) {
+		t.Error("Expected estimate of 10 items with 100 bytes each plus overhead, got", n)
+	}
+	if n := table.EstimateBytes(nil); n != 10*itemOverhead {
+		t.Error("Expected estimate of the overhead only, got", n)
+	}
+}
+
+func TestAddChecked(t *testing.T) {
+	table := Cache("testAddChecked", false)
+	table.SetMaxItems(3)
+	for i := 0; i < 3; i++ {
+		if _, err := table.AddChecked(i, 0, v); err != nil {
+			t.Error("Error adding item below capacity:", err)
+		}
+	}
+
+	if item, err := table.AddChecked(3, 0, v); !errors.Is(err, ErrCacheFull) || item != nil {
+		t.Error("Expected adding beyond capacity to fail, got", err)
+	}
+	if table.Count() != 3 || !table.Exists(0) {
+		t.Error("Expected AddChecked not to evict anything")
+	}
+
+	// Replacing an existing item doesn't need more room.
+	if _, err := table.AddChecked(0, 0, v+"_new"); err != nil {
+		t.Error("Error replacing item at capacity:", err)
+	}
+
+	table.SetMaxItems(0)
+	table.SetMaxBytes(10, func(item *CacheItem) int64 { return int64(len(item.Data().(string))) })
+	table.Flush()
+	if _, err := table.AddChecked(k, 0, "12345"); err != nil {
+		t.Error("Error adding item below byte limit:", err)
+	}
+	if _, err := table.AddChecked(k+"_2", 0, "123456"); !errors.Is(err, ErrCacheFull) {
+		t.Error("Expected adding beyond the byte limit to fail, got", err)
+	}
+	if _, err := table.AddChecked(k, 0, "1234567890"); err != nil {
+		t.Error("Error replacing item within byte limit:", err)
+	}
+}
+
+func TestEvictionChan(t *testing.T) {
+	table := Cache("testEvictionChan", false)
+	first := table.EvictionChan(2)
+	second := table.EvictionChan(2)
+
+	expiring := table.Add(k, 50*time.Millisecond, v)
+	for _, ch := range []<-chan *CacheItem{first, second} {
+		select {
+		case item := <-ch:
+			if item != expiring {
+				t.Error("Expected the expired item, got", item.Key())
+			}
+		case <-time.After(time.Second):
+			t.Error("Expired item was not published")
+		}
+	}
+
+	// Evictions are published as well, but explicit deletes are not.
+	table.SetMaxItems(1)
+	evicted := table.Add(k+"_1", 0, v)
+	table.Add(k+"_2", 0, v)
+	if item := <-first; item != evicted {
+		t.Error("Expected the evicted item, got", item.Key())
+	}
+	_, _ = table.Delete(k + "_2")
+
+	// Full buffers drop items instead of blocking.
+	table.SetMaxItems(0)
+	for i := 0; i < 4; i++ {
+		table.Add(i, 0, v)
+	}
+	table.SetMaxItems(1)
+
+	// Stop closes the channels after the buffered items.
+	table.Stop()
+	for _, ch := range []<-chan *CacheItem{first, second} {
+		n := 0
+		for range ch {
+			n++
+		}
+		if n != 2 {
+			t.Error("Expected the buffer of 2 to be filled before dropping, got", n)
+		}
+	}
+}
+
+func TestValueTimeout(t *testing.T) {
+	table := Cache("testValueTimeout", false)
+	table.Add(k, 0, v)
+
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		table.Lock()
+		close(locked)
+		<-release
+		table.Unlock()
+	}()
+	<-locked
+
+	start := time.Now()
+	if _, err := table.ValueTimeout(k, 20*time.Millisecond); !errors.Is(err, ErrLockTimeout) {
+		t.Error("Expected lock timeout, got", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected ValueTimeout to give up in time, took", time.Since(start))
+	}
+	close(release)
+
+	if item, err := table.ValueTimeout(k, time.Second); err != nil || item.Data() != v {
+		t.Error("Expected hit once the lock was released, got", item, err)
+	}
+	if _, err := table.ValueTimeout(k+"_missing", time.Second); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected miss for missing key, got", err)
+	}
+
+	// Removing an expired item lazily doesn't wait past the timeout either.
+	table.SetLazyExpiration(true)
+	item := table.Add(k+"_expired", time.Minute, v)
+	item.Lock()
+	item.accessedOn = item.accessedOn.Add(-time.Hour)
+	item.Unlock()
+	table.RLock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := table.ValueTimeout(k+"_expired", 20*time.Millisecond)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Error("Expected expired item to be missing, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected ValueTimeout to give up removing the expired item in time")
+	}
+	table.RUnlock()
+}
+
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	table := Cache("testWithLogger", false, WithLogger(log.New(&buf, "", 0)))
+	table.Add(k, time.Minute, v)
+
+	out := buf.String()
+	if !strings.Contains(out, "Adding item with key "+k) ||
+		!strings.Contains(out, "Expiration check installed for table testWithLogger") {
+		t.Error("Expected early log output to go to the provided logger, got", out)
+	}
+}
+
+func TestItemEncoder(t *testing.T) {
+	type handler struct {
+		name string
+		fn   func() string
+	}
+	type encodedHandler struct {
+		Key  string
+		Name string
+	}
+	handlers := map[string]func() string{
+		"hello": func() string { return "hello" },
+	}
+
+	table := Cache("testItemEncoder", false)
+	table.SetItemEncoder(func(item *CacheItem) ([]byte, error) {
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(encodedHandler{
+			Key:  item.Key().(string),
+			Name: item.Data().(handler).name,
+		})
+		return buf.Bytes(), err
+	})
+	table.SetItemDecoder(func(data []byte) (*CacheItem, error) {
+		var eh encodedHandler
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&eh); err != nil {
+			return nil, err
+		}
+		return NewCacheItem(eh.Key, 0, handler{eh.Name, handlers[eh.Name]}), nil
+	})
+	table.Add(k, time.Minute, handler{"hello", handlers["hello"]})
+
+	path := filepath.Join(t.TempDir(), "table.gob")
+	if err := table.SaveToFile(path); err != nil {
+		t.Fatal("Error saving table:", err)
+	}
+	table.Flush()
+	if err := table.LoadFromFile(path); err != nil {
+		t.Fatal("Error loading table:", err)
+	}
+
+	item, err := table.Value(k)
+	if err != nil {
+		t.Fatal("Error retrieving restored item:", err)
+	}
+	if h := item.Data().(handler); h.fn() != "hello" {
+		t.Error("Expected decoder to restore the item's data")
+	}
+	if item.LifeSpan() <= 0 || item.LifeSpan() > time.Minute {
+		t.Error("Expected restored item to keep its remaining lifespan, got", item.LifeSpan())
+	}
+
+	b, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal("Error marshaling table:", err)
+	}
+	var snapshot struct {
+		Items []struct {
+			Key     interface{}
+			Encoded []byte
+		}
+	}
+	if err := json.Unmarshal(b, &snapshot); err != nil || len(snapshot.Items) != 1 {
+		t.Fatal("Unexpected snapshot:", string(b), err)
+	}
+	var eh encodedHandler
+	if err := gob.NewDecoder(bytes.NewReader(snapshot.Items[0].Encoded)).Decode(&eh); err != nil || eh.Key != k || eh.Name != "hello" {
+		t.Error("Expected snapshot to contain the encoded item, got", eh, err)
+	}
+
+	// Encoded items can't be loaded without a decoder.
+	table.SetItemDecoder(nil)
+	if err := table.LoadFromFile(path); !errors.Is(err, ErrNoItemDecoder) {
+		t.Error("Expected loading without a decoder to fail, got", err)
+	}
+}
+
+func TestValueFresh(t *testing.T) {
+	table := Cache("testValueFresh", true)
+	table.Add(k, time.Minute, v)
+	table.Add(k+"_forever", 0, v)
+	if _, err := table.ValueFresh(k); err != nil {
+		t.Error("Expected fresh item to be returned, got", err)
+	}
+
+	// Let the item expire without waiting for the timer.
+	table.Foreach(func(key interface{}, item *CacheItem) {
+		item.Lock()
+		item.createdOn = item.createdOn.Add(-time.Hour)
+		item.Unlock()
+	})
+	if _, err := table.ValueFresh(k); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected stale item to be a miss, got", err)
+	}
+	if _, err := table.Value(k); err != nil {
+		t.Error("Expected Value to still return the stale item, got", err)
+	}
+	if _, err := table.ValueFresh(k + "_forever"); err != nil {
+		t.Error("Expected never-expiring item to be returned, got", err)
+	}
+	if _, err := table.ValueFresh(k + "_missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected missing item to be a miss, got", err)
+	}
+}
+
+func TestLazyExpiration(t *testing.T) {
+	table := Cache("testLazyExpiration", true)
+	table.SetLazyExpiration(true)
+	expired := table.EvictionChan(1)
+	table.Add(k, time.Minute, v)
+	table.Add(k+"_fresh", time.Minute, v)
+
+	// Let the item expire without waiting for the timer.
+	item, _ := table.Value(k)
+	item.Lock()
+	item.createdOn = item.createdOn.Add(-time.Hour)
+	item.Unlock()
+
+	if _, err := table.Value(k); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected stale item to be a miss, got", err)
+	}
+	if table.Exists(k) {
+		t.Error("Expected stale item to be removed on access")
+	}
+	if removed := <-expired; removed != item {
+		t.Error("Expected lazily removed item to be published")
+	}
+	if _, err := table.Value(k + "_fresh"); err != nil {
+		t.Error("Expected fresh item to be returned, got", err)
+	}
+
+	// Without lazy expiration, stale items are returned until the sweep.
+	table.SetLazyExpiration(false)
+	item = table.Add(k, time.Minute, v)
+	item.Lock()
+	item.createdOn = item.createdOn.Add(-time.Hour)
+	item.Unlock()
+	if _, err := table.Value(k); err != nil {
+		t.Error("Expected stale item to be returned, got", err)
+	}
+}
+
+func TestAddWithExpiry(t *testing.T) {
+	table := Cache("testAddWithExpiry", false)
+	expiresAt := time.Now().Add(100 * time.Millisecond)
+	absolute := table.AddWithExpiry(k+"_absolute", expiresAt, v)
+	table.Add(k+"_relative", 100*time.Millisecond, v)
+	table.AddWithExpiry(k+"_past", time.Now().Add(-time.Minute), v)
+
+	if !absolute.ExpiresAt().Equal(expiresAt) {
+		t.Error("Expected item to keep its expiry time, got", absolute.ExpiresAt())
+	}
+	if ttl, err := table.TTL(k + "_absolute"); err != nil || ttl <= 0 || ttl > 100*time.Millisecond {
+		t.Error("Expected TTL up to the expiry time, got", ttl, err)
+	}
+
+	// Accessing both items keeps the relative one alive only.
+	for i := 0; i < 5; i++ {
+		time.Sleep(30 * time.Millisecond)
+		_, _ = table.Value(k + "_absolute")
+		_, _ = table.Value(k + "_relative")
+	}
+	if table.Exists(k + "_absolute") {
+		t.Error("Expected item to expire at its expiry time despite accesses")
+	}
+	if !table.Exists(k + "_relative") {
+		t.Error("Expected accessed relative item to be kept alive")
+	}
+	if table.Exists(k + "_past") {
+		t.Error("Expected item with an expiry in the past to be removed")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	table := Cache("testReplace", false)
+	item := table.Add(k, 0, v)
+
+	if ok, err := table.Replace(k, time.Minute, v+"_new"); !ok || err != nil {
+		t.Error("Expected existing item to be replaced, got", ok, err)
+	}
+	if item.Data() != v+"_new" || item.LifeSpan() != time.Minute {
+		t.Error("Expected item's data and lifespan to be replaced, got", item.Data(), item.LifeSpan())
+	}
+
+	if ok, err := table.Replace(k+"_missing", time.Minute, v); ok || err != nil {
+		t.Error("Expected missing key not to be replaced, got", ok, err)
+	}
+	if table.Exists(k + "_missing") {
+		t.Error("Expected Replace not to create missing keys")
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	table := Cache("testFreeze", false)
+	table.Add(k, 0, v)
+	table.Freeze()
+
+	if item := table.Add(k+"_new", 0, v); item != nil || table.Exists(k+"_new") {
+		t.Error("Expected Add to be rejected while frozen")
+	}
+	if _, err := table.Delete(k); !errors.Is(err, ErrTableFrozen) {
+		t.Error("Expected Delete to be rejected while frozen, got", err)
+	}
+	if err := table.UpdateData(k, v+"_new"); !errors.Is(err, ErrTableFrozen) {
+		t.Error("Expected UpdateData to be rejected while frozen, got", err)
+	}
+	if _, err := table.Replace(k, 0, v+"_new"); !errors.Is(err, ErrTableFrozen) {
+		t.Error("Expected Replace to be rejected while frozen, got", err)
+	}
+	if err := table.Touch(k); !errors.Is(err, ErrTableFrozen) {
+		t.Error("Expected Touch to be rejected while frozen, got", err)
+	}
+	if item, err := table.Value(k); err != nil || item.Data() != v {
+		t.Error("Expected reads to succeed while frozen, got", item, err)
+	}
+
+	// Loaded data can't be cached while frozen.
+	if _, err := table.ValueOrLoad(k+"_load", 0, func() (interface{}, error) {
+		return v, nil
+	}); !errors.Is(err, ErrTableFrozen) || table.Exists(k+"_load") {
+		t.Error("Expected ValueOrLoad to be rejected while frozen, got", err)
+	}
+	loaded := 0
+	table.SetDataLoadedCallback(func(*CacheItem) { loaded++ })
+	table.SetNegativeTTL(time.Minute)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		if key == k+"_load" {
+			return NewCacheItem(key, 0, v)
+		}
+		return nil
+	})
+	if _, err := table.Value(k + "_load"); !errors.Is(err, ErrTableFrozen) || table.Exists(k+"_load") || loaded != 0 {
+		t.Error("Expected loading to be rejected while frozen, got", err, loaded)
+	}
+	if _, err := table.Value(k + "_unloadable"); err != ErrKeyNotFoundOrLoadable {
+		t.Error("Expected ErrKeyNotFoundOrLoadable while frozen, got", err)
+	}
+
+	table.Unfreeze()
+	if _, err := table.Value(k + "_unloadable"); errors.Is(err, ErrNegativeCached) {
+		t.Error("Expected no negative entry to be recorded while frozen")
+	}
+	if item := table.Add(k+"_new", 0, v); item == nil || !table.Exists(k+"_new") {
+		t.Error("Expected Add to work again after unfreezing")
+	}
+	if _, err := table.Delete(k); err != nil {
+		t.Error("Expected Delete to work again after unfreezing, got", err)
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	table := Cache("testMultiGet", false)
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), 0, i)
+	}
+
+	found := table.MultiGet().Add(k + "0").Add(k + "2").Add(k + "_missing").Do()
+	if len(found) != 2 {
+		t.Error("Expected 2 items, got", len(found))
+	}
+	for _, key := range []string{k + "0", k + "2"} {
+		if item, ok := found[key]; !ok || item.Key() != key {
+			t.Error("Expected item for key", key)
+		}
+	}
+	if _, ok := found[k+"_missing"]; ok {
+		t.Error("Expected missing key to be left out")
+	}
+	if hits, misses, _ := table.Stats(); hits != 2 || misses != 1 {
+		t.Error("Expected lookups to be counted, got", hits, misses)
+	}
+}
+
+func TestReapNowKeys(t *testing.T) {
+	table := Cache("testReapNowKeys", false)
+	table.Add(k, 0, v)
+	for i := 0; i < 3; i++ {
+		table.Add(k+strconv.Itoa(i), time.Minute, v)
+	}
+	if keys := table.ReapNowKeys(); len(keys) != 0 {
+		t.Error("Expected nothing to be reaped, got", keys)
+	}
+
+	// Let two items expire without waiting for the timer.
+	for _, key := range []string{k + "0", k + "2"} {
+		item, _ := table.Value(key)
+		item.Lock()
+		item.accessedOn = item.accessedOn.Add(-time.Hour)
+		item.Unlock()
+	}
+	keys := table.ReapNowKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].(string) < keys[j].(string) })
+	if len(keys) != 2 || keys[0] != k+"0" || keys[1] != k+"2" {
+		t.Error("Expected the expired keys to be returned, got", keys)
+	}
+	if table.Count() != 2 {
+		t.Error("Expected 2 items to remain, got", table.Count())
+	}
+}
+
+func TestDumpToAndLoadFrom(t *testing.T) {
+	src := Cache("testDumpTo", false)
+	for i := 0; i < 2500; i++ {
+		src.Add(k+strconv.Itoa(i), time.Minute, v)
+	}
+	src.Add(k+"_forever", 0, 42)
+	expiresAt := time.Now().Add(time.Hour).Round(0)
+	src.AddWithExpiry(k+"_absolute", expiresAt, v)
+	src.AddWithPolicy(k+"_sliding", time.Minute, v, ExpireSliding)
+	src.AddWithPriority(k+"_priority", 0, v, 7)
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(src.DumpTo(w))
+	}()
+
+	dst := Cache("testLoadFrom", false)
+	if err := dst.LoadFrom(r); err != nil {
+		t.Fatal("Error loading dump:", err)
+	}
+	if dst.Count() != src.Count() {
+		t.Error("Expected", src.Count(), "items, got", dst.Count())
+	}
+
+	item, err := dst.Value(k + "1234")
+	if err != nil || item.Data() != v {
+		t.Error("Error restoring item:", item, err)
+	} else if item.LifeSpan() != time.Minute {
+		t.Error("Expected restored item to keep its lifespan, got", item.LifeSpan())
+	}
+	item, err = dst.Value(k + "_forever")
+	if err != nil || item.Data() != 42.0 || item.LifeSpan() != 0 {
+		t.Error("Error restoring never-expiring item:", item, err)
+	}
+	if item, err = dst.Peek(k + "_absolute"); err != nil || !item.ExpiresAt().Equal(expiresAt) {
+		t.Error("Expected restored item to keep its absolute expiry, got", item, err)
+	}
+	if item, err = dst.Peek(k + "_sliding"); err != nil || item.Policy() != ExpireSliding {
+		t.Error("Expected restored item to keep its policy, got", item, err)
+	}
+	if item, err = dst.Peek(k + "_priority"); err != nil || item.Priority() != 7 {
+		t.Error("Expected restored item to keep its priority, got", item, err)
+	}
+}
+
+func TestDumpToUnlocked(t *testing.T) {
+	table := Cache("testDumpToUnlocked", false)
+	defer table.Stop()
+	table.Add(k, time.Minute, v)
+
+	// DumpTo blocks writing the first line until the pipe gets read.
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(table.DumpTo(w))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	added := make(chan struct{})
+	go func() {
+		table.Add(k+"_new", 0, v)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Error("Expected the table to stay writable while dumping")
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Error("Error reading dump:", err)
+	}
+}
+
+func TestForeachConcurrentModification(t *testing.T) {
+	table := Cache("testForeachConcurrentModification", false)
+	for i := 0; i < 100; i++ {
+		table.Add(i, 0, v)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := w*1000 + i%500
+				table.Add(key, 0, v)
+				_, _ = table.Delete(key - 1)
+			}
+		}(w)
+	}
+
+	for i := 0; i < 50; i++ {
+		table.Foreach(func(key interface{}, item *CacheItem) {
+			// Callbacks may use the table while it's being modified.
+			_ = table.Exists(key)
+			_ = item.Data()
+		})
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestMissCallback(t *testing.T) {
+	table := Cache("testMissCallback", false)
+	table.Add(k, 0, v)
+	var missed []interface{}
+	table.SetMissCallback(func(key interface{}) {
+		missed = append(missed, key)
+	})
+
+	_, _ = table.Value(k)
+	_, _ = table.Value(k + "_1")
+	_, _ = table.Value(k)
+	_, _ = table.Value(k + "_2")
+	if len(missed) != 2 || missed[0] != k+"_1" || missed[1] != k+"_2" {
+		t.Error("Expected callback once per miss, got", missed)
+	}
+
+	table.SetMissCallback(nil)
+	_, _ = table.Value(k + "_3")
+	if len(missed) != 2 {
+		t.Error("Expected no callback after removing it, got", missed)
+	}
+}
+
+func TestHeapExpiration(t *testing.T) {
+	table := Cache("testHeapExpiration", false)
+	table.Add(k+"_before", 50*time.Millisecond, v)
+	table.SetHeapExpiration(true)
+	table.Add(k+"_short", 50*time.Millisecond, v)
+	table.Add(k+"_accessed", 100*time.Millisecond, v)
+	table.Add(k+"_shortened", time.Hour, v)
+	table.Add(k+"_forever", 0, v)
+	if err := table.SetLifeSpan(k+"_shortened", 50*time.Millisecond); err != nil {
+		t.Error("Error setting lifespan:", err)
+	}
+
+	// Keep one item alive past its initially scheduled expiry.
+	for i := 0; i < 5; i++ {
+		time.Sleep(40 * time.Millisecond)
+		_, _ = table.Value(k + "_accessed")
+	}
+
+	for _, key := range []string{k + "_before", k + "_short", k + "_shortened"} {
+		if table.Exists(key) {
+			t.Error("Expected item to expire:", key)
+		}
+	}
+	if !table.Exists(k+"_accessed") || !table.Exists(k+"_forever") {
+		t.Error("Expected accessed and never-expiring items to be kept")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if table.Exists(k + "_accessed") {
+		t.Error("Expected item to expire once no longer accessed")
+	}
+	if table.Count() != 1 {
+		t.Error("Expected only the never-expiring item to be left, got", table.Count())
+	}
+}
+
+func TestHeapExpirationEntries(t *testing.T) {
+	table := Cache("testHeapExpirationEntries", false)
+	defer table.Stop()
+	table.SetHeapExpiration(true)
+	heapLen := func() int {
+		table.RLock()
+		defer table.RUnlock()
+		return table.expiryHeap.Len()
+	}
+
+	table.Add(k, time.Hour, v)
+	for i := 0; i < 10; i++ {
+		_ = table.Touch(k)
+		_ = table.SetLifeSpan(k, time.Duration(i+1)*time.Hour)
+		table.Add(k+"_replaced", time.Hour, v)
+	}
+	if n := heapLen(); n != 2 {
+		t.Error("Expected one heap entry per item, got", n)
+	}
+
+	_ = table.SetLifeSpan(k+"_replaced", 0)
+	if n := heapLen(); n != 1 {
+		t.Error("Expected never-expiring item to leave the heap, got", n)
+	}
+	_, _ = table.Delete(k)
+	if n := heapLen(); n != 0 {
+		t.Error("Expected deleted item to leave the heap, got", n)
+	}
+}
+
+func benchmarkReapNow(b *testing.B, items int, useHeap bool) {
+	const expired = 100
+	table := Cache("benchmarkReapNow", false)
+	defer table.Stop()
+	table.SetHeapExpiration(useHeap)
+	for i := 0; i < items; i++ {
+		table.Add(i, time.Hour, v)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Insert expired items directly, as adding them would reap them
+		// right away.
+		b.StopTimer()
+		table.Lock()
+		for j := 0; j < expired; j++ {
+			item := NewCacheItemWithAbsoluteExpiry(k+strconv.Itoa(j), time.Now().Add(-time.Second), v)
+			table.items[item.key] = item
+			table.scheduleInternal(item)
+		}
+		table.Unlock()
+		b.StartTimer()
+
+		table.ReapNow()
+	}
+}
+
+func BenchmarkReapNowScan10k(b *testing.B) {
+	benchmarkReapNow(b, 10000, false)
+}
+
+func BenchmarkReapNowScan100k(b *testing.B) {
+	benchmarkReapNow(b, 100000, false)
+}
+
+func BenchmarkReapNowHeap10k(b *testing.B) {
+	benchmarkReapNow(b, 10000, true)
+}
+
+func BenchmarkReapNowHeap100k(b *testing.B) {
+	benchmarkReapNow(b, 100000, true)
+}
+
+func TestValueAs(t *testing.T) {
+	table := Cache("testValueAs", false)
+	table.Add(k, 0, 42)
+
+	if n, err := ValueAs[int](table, k); err != nil || n != 42 {
+		t.Error("Expected typed value, got", n, err)
+	}
+	if s, err := ValueAs[string](table, k); !errors.Is(err, ErrTypeMismatch) || s != "" {
+		t.Error("Expected type mismatch, got", s, err)
+	}
+	if _, err := ValueAs[int](table, k+"_missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected missing key to fail, got", err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	table := Cache("testPeek", false)
+	item := table.Add(k, time.Minute, v)
+	accessedOn := item.AccessedOn()
+
+	time.Sleep(time.Millisecond)
+	if p, err := table.Peek(k); err != nil || p.Data() != v {
+		t.Error("Expected Peek to return the item, got", p, err)
+	}
+	if item.AccessCount() != 0 || !item.AccessedOn().Equal(accessedOn) {
+		t.Error("Expected Peek not to touch the item's access metadata")
+	}
+	if hits, misses, _ := table.Stats(); hits != 0 || misses != 0 {
+		t.Error("Expected Peek not to count as lookup, got", hits, misses)
+	}
+	if _, err := table.Peek(k + "_missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected missing key to fail, got", err)
+	}
+
+	_, _ = table.Value(k)
+	if item.AccessCount() != 1 || !item.AccessedOn().After(accessedOn) {
+		t.Error("Expected Value to update the item's access metadata")
+	}
+}
+
+func TestAddReturningOld(t *testing.T) {
+	table := Cache("testAddReturningOld", false)
+
+	if old, replaced := table.AddReturningOld(k, 0, v); replaced || old != nil {
+		t.Error("Expected no previous item for a new key, got", old)
+	}
+	if old, replaced := table.AddReturningOld(k, 0, v+"_new"); !replaced || old == nil || old.Data() != v {
+		t.Error("Expected the previous item to be returned, got", old)
+	}
+	if item, err := table.Value(k); err != nil || item.Data() != v+"_new" {
+		t.Error("Expected the new value to be stored, got", item, err)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	table := Cache("testHealthy", false)
+	if !table.Healthy() {
+		t.Error("Expected table without scheduled checks to be healthy")
+	}
+	table.Add(k, time.Minute, v)
+	if !table.Healthy() {
+		t.Error("Expected table with a pending check to be healthy")
+	}
+
+	// Simulate a stalled expiration check.
+	table.Lock()
+	table.cleanupTimer.Stop()
+	atomic.StoreInt64(&table.checkDeadline, time.Now().Add(-time.Second).UnixNano())
+	table.Unlock()
+	if table.Healthy() {
+		t.Error("Expected table with an overdue check to be unhealthy")
+	}
+
+	table.ReapNow()
+	if !table.Healthy() {
+		t.Error("Expected table to be healthy again after a check")
+	}
+}
+
+func TestLockContention(t *testing.T) {
+	table := Cache("testLockContention", false)
+	defer table.Stop()
+	table.Add(k, 0, v)
+
+	// Contention isn't counted unless enabled.
+	table.Lock()
+	done := make(chan struct{})
+	go func() {
+		_, _ = table.Value(k)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	table.Unlock()
+	<-done
+	if n := table.Metrics().LockContention; n != 0 {
+		t.Error("Expected no contention to be counted while disabled, got", n)
+	}
+
+	table.SetLockContentionTracking(true)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				table.Add(w*1000+i, 0, v)
+				_, _ = table.Value(k)
+			}
+		}(w)
+	}
+
+	// Make sure at least one caller has to wait.
+	table.Lock()
+	time.Sleep(10 * time.Millisecond)
+	table.Unlock()
+	wg.Wait()
+
+	if n := table.Metrics().LockContention; n == 0 {
+		t.Error("Expected contention to be counted under concurrent access")
+	}
+}
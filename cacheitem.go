@@ -8,10 +8,23 @@
 package cache2go
 
 import (
+	"container/list"
 	"sync"
 	"time"
 )
 
+// ExpirationPolicy determines from when an item's lifespan is counted.
+type ExpirationPolicy int
+
+const (
+	// ExpireByTable uses the expiration mode of the item's table.
+	ExpireByTable ExpirationPolicy = iota
+	// ExpireSliding counts the lifespan from the item's last access.
+	ExpireSliding
+	// ExpireAbsolute counts the lifespan from the item's creation.
+	ExpireAbsolute
+)
+
 // CacheItem is an individual cache item
 // Parameter data contains the user-set value in the cache.
 type CacheItem struct {
@@ -23,6 +36,9 @@ type CacheItem struct {
 	data interface{}
 	// How long will the item live in the cache when not being accessed/kept alive.
 	lifeSpan time.Duration
+	// When the item expires regardless of its lifespan, zero if it expires
+	// relative to its creation or last access.
+	expiresAt time.Time
 
 	// Creation timestamp.
 	createdOn time.Time
@@ -30,9 +46,29 @@ type CacheItem struct {
 	accessedOn time.Time
 	// How often the item was accessed.
 	accessCount int64
+	// Eviction priority, lower priorities get evicted first.
+	priority int
+	// From when the lifespan is counted.
+	policy ExpirationPolicy
+	// Whether adding this item replaced an existing item with the same key.
+	overwrote bool
 
 	// Callback method triggered right before removing the item from the cache
-	aboutToExpire []func(key interface{})
+	aboutToExpire []func(key interface{}) bool
+	// Callback method triggered when the item is accessed via Value.
+	accessed []func(item *CacheItem)
+
+	// Whether this item is being deleted, guarded by the table's mutex.
+	deleting bool
+	// When the item is due in the table's expiry heap and its position in
+	// it plus one, or 0 if it isn't in it. Both are guarded by the table's
+	// mutex.
+	heapDeadline time.Time
+	heapIndex    int
+	// The table's access order while it has limits, and this item's place
+	// in it, guarded by the list's mutex.
+	lru        *lruList
+	lruElement *list.Element
 }
 
 // NewCacheItem returns a newly created CacheItem.
@@ -53,20 +89,48 @@ func NewCacheItem(key interface{}, lifeSpan time.Duration, data interface{}) *Ca
 	}
 }
 
+// NewCacheItemWithAbsoluteExpiry returns a newly created CacheItem which
+// expires at the given time, no matter how often it gets accessed. Its
+// lifespan is the time left until then, but at least a nanosecond.
+func NewCacheItemWithAbsoluteExpiry(key interface{}, expiresAt time.Time, data interface{}) *CacheItem {
+	lifeSpan := time.Until(expiresAt)
+	if lifeSpan <= 0 {
+		lifeSpan = time.Nanosecond
+	}
+
+	item := NewCacheItem(key, lifeSpan, data)
+	item.expiresAt = expiresAt
+	return item
+}
+
 // KeepAlive marks an item to be kept for another expireDuration period.
 func (item *CacheItem) KeepAlive() {
 	item.Lock()
-	defer item.Unlock()
 	item.accessedOn = time.Now()
 	item.accessCount++
+	lru := item.lru
+	item.Unlock()
+
+	if lru != nil {
+		lru.touch(item)
+	}
 }
 
 // LifeSpan returns this item's expiration duration.
 func (item *CacheItem) LifeSpan() time.Duration {
-	// immutable
+	item.RLock()
+	defer item.RUnlock()
 	return item.lifeSpan
 }
 
+// ExpiresAt returns when this item expires if it was created with an absolute
+// expiry, or the zero time otherwise.
+func (item *CacheItem) ExpiresAt() time.Time {
+	item.RLock()
+	defer item.RUnlock()
+	return item.expiresAt
+}
+
 // AccessedOn returns when this item was last accessed.
 func (item *CacheItem) AccessedOn() time.Time {
 	item.RLock()
@@ -76,7 +140,8 @@ func (item *CacheItem) AccessedOn() time.Time {
 
 // CreatedOn returns when this item was added to the cache.
 func (item *CacheItem) CreatedOn() time.Time {
-	// immutable
+	item.RLock()
+	defer item.RUnlock()
 	return item.createdOn
 }
 
@@ -93,15 +158,89 @@ func (item *CacheItem) Key() interface{} {
 	return item.key
 }
 
+// Priority returns the eviction priority of this cached item.
+func (item *CacheItem) Priority() int {
+	// immutable
+	return item.priority
+}
+
+// Policy returns the expiration policy of this cached item.
+func (item *CacheItem) Policy() ExpirationPolicy {
+	// immutable
+	return item.policy
+}
+
+// Overwrote returns whether adding this item to the cache replaced an
+// existing item with the same key.
+func (item *CacheItem) Overwrote() bool {
+	// immutable once added
+	return item.overwrote
+}
+
 // Data returns the value of this cached item.
 func (item *CacheItem) Data() interface{} {
-	// immutable
+	item.RLock()
+	defer item.RUnlock()
 	return item.data
 }
 
+// expiresIn returns how long this item has left until it expires in a table
+// with the given expiration mode, which is zero or negative if it already
+// exceeded its lifespan. The returned bool is false if it never expires.
+func (item *CacheItem) expiresIn(now time.Time, expireByCreateTime bool) (time.Duration, bool) {
+	item.RLock()
+	defer item.RUnlock()
+
+	if !item.expiresAt.IsZero() {
+		return item.expiresAt.Sub(now), true
+	}
+	if item.lifeSpan == 0 {
+		return 0, false
+	}
+	checkTime := item.accessedOn
+	if !item.sliding(expireByCreateTime) {
+		checkTime = item.createdOn
+	}
+
+	return item.lifeSpan - now.Sub(checkTime), true
+}
+
+// sliding returns whether this item's lifespan is counted from its last
+// access rather than its creation in a table with the given expiration mode.
+func (item *CacheItem) sliding(expireByCreateTime bool) bool {
+	switch item.policy {
+	case ExpireSliding:
+		return true
+	case ExpireAbsolute:
+		return false
+	default:
+		return !expireByCreateTime
+	}
+}
+
+// cloneWith returns a copy of this item holding the given data. The copy isn't
+// stored in any cache table and has no callbacks.
+func (item *CacheItem) cloneWith(data interface{}) *CacheItem {
+	item.RLock()
+	defer item.RUnlock()
+	return &CacheItem{
+		key:         item.key,
+		lifeSpan:    item.lifeSpan,
+		expiresAt:   item.expiresAt,
+		createdOn:   item.createdOn,
+		accessedOn:  item.accessedOn,
+		accessCount: item.accessCount,
+		priority:    item.priority,
+		policy:      item.policy,
+		data:        data,
+	}
+}
+
 // SetAboutToExpireCallback configures a callback, which will be called right
-// before the item is about to be removed from the cache.
-func (item *CacheItem) SetAboutToExpireCallback(f func(interface{})) {
+// before the item is about to be removed from the cache. When the item
+// expires and any callback returns true, the item is kept and its lifespan
+// starts over. The return value is ignored for all other removals.
+func (item *CacheItem) SetAboutToExpireCallback(f func(interface{}) bool) {
 	if len(item.aboutToExpire) > 0 {
 		item.RemoveAboutToExpireCallback()
 	}
@@ -111,7 +250,7 @@ func (item *CacheItem) SetAboutToExpireCallback(f func(interface{})) {
 }
 
 // AddAboutToExpireCallback appends a new callback to the AboutToExpire queue
-func (item *CacheItem) AddAboutToExpireCallback(f func(interface{})) {
+func (item *CacheItem) AddAboutToExpireCallback(f func(interface{}) bool) {
 	item.Lock()
 	defer item.Unlock()
 	item.aboutToExpire = append(item.aboutToExpire, f)
@@ -123,3 +262,18 @@ func (item *CacheItem) RemoveAboutToExpireCallback() {
 	defer item.Unlock()
 	item.aboutToExpire = nil
 }
+
+// AddAccessCallback appends a new callback to the accessed queue, which will
+// be called every time the item is found by Value.
+func (item *CacheItem) AddAccessCallback(f func(*CacheItem)) {
+	item.Lock()
+	defer item.Unlock()
+	item.accessed = append(item.accessed, f)
+}
+
+// RemoveAccessCallback empties the accessed callback queue
+func (item *CacheItem) RemoveAccessCallback() {
+	item.Lock()
+	defer item.Unlock()
+	item.accessed = nil
+}
@@ -8,14 +8,69 @@
 package cache2go
 
 import (
+	"context"
 	"log"
+	"math/rand"
+	"reflect"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
+// lockRetryInterval is how long ValueTimeout waits between attempts to lock
+// the table.
+const lockRetryInterval = 100 * time.Microsecond
+
+// heapCheckInterval is how often adding items may check the heap size for
+// SetHeapThreshold at most.
+const heapCheckInterval = time.Second
+
+// heapEvictFraction is the fraction of items evicted whenever the heap exceeds
+// the threshold configured with SetHeapThreshold, but at least one.
+const heapEvictFraction = 0.1
+
+// healthyIntervals is how many timer intervals an expiration check may be
+// late before Healthy reports the table as unhealthy, but at least a second.
+const healthyIntervals = 3
+
+// itemOverhead is the estimated memory used per item apart from its data: the
+// map entry, holding an interface key, a pointer and its hash byte, plus the
+// CacheItem itself.
+const itemOverhead = int64(unsafe.Sizeof(interface{}(nil))+unsafe.Sizeof((*CacheItem)(nil))+1) +
+	int64(unsafe.Sizeof(CacheItem{}))
+
+// heapAlloc returns the number of bytes currently allocated on the heap. It
+// is a variable so tests can simulate memory pressure.
+var heapAlloc = func() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
 // CacheTable is a table within the cache
 type CacheTable struct {
+	// Statistics, only accessed atomically. Keep them at the top of the
+	// struct to guarantee 64-bit alignment on 32-bit platforms.
+	hits        int64
+	misses      int64
+	adds        int64
+	deletes     int64
+	evictions   int64
+	expirations int64
+	// How often Add or Value had to wait for the table lock.
+	contention int64
+	// Total size of all items, only accessed atomically.
+	bytes int64
+	// When the next expiration check is overdue in Unix nanoseconds, 0 if
+	// none is scheduled. Only accessed atomically.
+	checkDeadline int64
+	// Whether contention gets counted, 1 if enabled. Only accessed
+	// atomically.
+	countContention int32
+
 	sync.RWMutex
 
 	// The table's name.
@@ -27,35 +82,147 @@ type CacheTable struct {
 	cleanupTimer *time.Timer
 	// Current timer duration.
 	cleanupInterval time.Duration
+	// Fraction of the timer duration by which the timer gets randomly
+	// delayed.
+	cleanupJitter float64
+	// Items ordered by expiry, nil unless heap expiration is enabled.
+	expiryHeap *expiryHeap
 
 	// The logger used for this table.
 	logger *log.Logger
 
 	// Callback method triggered when trying to load a non-existing key.
 	loadData func(key interface{}, args ...interface{}) *CacheItem
+	// How long to remember keys loadData couldn't load, 0 to not remember them.
+	negativeTTL time.Duration
+	// Keys loadData couldn't load, mapped to when loading them may be tried
+	// again. They are kept apart from items, so nothing else sees them.
+	negatives map[interface{}]time.Time
+	// Callback method triggered after adding an item fetched by loadData.
+	dataLoaded func(item *CacheItem)
+	// Callback method copying an item's data before returning it from Value.
+	cloneOnRead func(data interface{}) interface{}
+	// Callback methods encoding and decoding items for persistence.
+	itemEncoder func(item *CacheItem) ([]byte, error)
+	itemDecoder func(data []byte) (*CacheItem, error)
 	// Callback method triggered when adding a new item to the cache.
 	addedItem []func(item *CacheItem)
+	// Callback method triggered when adding an item replaced another one.
+	overwritten func(old, new *CacheItem)
+	// Callback method triggered when an item is accessed via Value.
+	accessedItem []func(item *CacheItem)
+	// Callback method triggered when Value doesn't find an item.
+	missed func(key interface{})
 	// Callback method triggered before deleting an item from the cache.
 	aboutToDeleteItem []func(item *CacheItem)
+	// Callback method triggered after each expiration check.
+	cleanedUp func(removed int, duration time.Duration)
 	// expire check by createdtime
 	expireByCreateTime bool
+	// Whether Value removes expired items instead of returning them.
+	lazyExpiration bool
+	// Whether adding, updating and deleting items is rejected.
+	frozen bool
+	// Channels receiving expired and evicted items.
+	evictionChans []chan *CacheItem
+	// Goroutines waiting in WaitForKey, by key.
+	waiters map[interface{}][]chan *CacheItem
+	// In-flight calls of ValueOrLoad, guarded by loadingMutex.
+	loading      map[interface{}]*loadCall
+	loadingMutex sync.Mutex
+
+	// Maximum number of items before the least recently accessed ones get
+	// evicted, 0 if unlimited.
+	maxItems int
+	// Maximum total size of all items before the least recently accessed
+	// ones get evicted, 0 if unlimited.
+	maxBytes int64
+	// Callback method returning the size of an item.
+	sizeOf func(item *CacheItem) int64
+	// Items in access order, only kept up to date while lruEnabled is set,
+	// i.e. while the table has limits or a heap threshold.
+	lru        *lruList
+	lruEnabled bool
+	// Heap size in bytes above which the lowest priority items get evicted,
+	// 0 if disabled.
+	heapThreshold uint64
+	// When the heap size was last checked against heapThreshold.
+	lastHeapCheck time.Time
+}
+
+// Name returns the name of this cache table.
+func (table *CacheTable) Name() string {
+	table.RLock()
+	defer table.RUnlock()
+	return table.name
 }
 
-// Count returns how many items are currently stored in the cache.
+// Count returns how many items are currently stored in the cache. Items which
+// already exceeded their lifespan but haven't been removed by the expiration
+// check yet are still counted.
 func (table *CacheTable) Count() int {
 	table.RLock()
 	defer table.RUnlock()
 	return len(table.items)
 }
 
-// Foreach all items
+// Foreach calls trans for every item in the cache. The items are collected
+// before the first call, so trans may safely access the table itself. The
+// iteration order is unspecified and items may expire while iterating.
 func (table *CacheTable) Foreach(trans func(key interface{}, item *CacheItem)) {
+	table.RLock()
+	items := make([]*CacheItem, 0, len(table.items))
+	for _, v := range table.items {
+		items = append(items, v)
+	}
+	table.RUnlock()
+
+	for _, item := range items {
+		trans(item.key, item)
+	}
+}
+
+// ForeachN calls trans for at most n items in the cache and stops early as
+// soon as trans returns false. It returns how many items have been visited.
+// Like Foreach, trans may safely access the table itself.
+func (table *CacheTable) ForeachN(n int, trans func(key interface{}, item *CacheItem) bool) int {
+	if n <= 0 {
+		return 0
+	}
+
+	table.RLock()
+	items := make([]*CacheItem, 0, n)
+	for _, v := range table.items {
+		if len(items) == n {
+			break
+		}
+		items = append(items, v)
+	}
+	table.RUnlock()
+
+	visited := 0
+	for _, item := range items {
+		visited++
+		if !trans(item.key, item) {
+			break
+		}
+	}
+
+	return visited
+}
+
+// Keys returns the keys of all items in the cache, in unspecified order. The
+// result is a snapshot and may include keys of items which expire right after.
+func (table *CacheTable) Keys() []interface{} {
 	table.RLock()
 	defer table.RUnlock()
 
-	for k, v := range table.items {
-		trans(k, v)
+	keys := make([]interface{}, 0, len(table.items))
+	for k := range table.items {
+		keys = append(keys, k)
 	}
+
+	return keys
 }
 
 // SetDataLoader configures a data-loader callback, which will be called when
@@ -67,6 +234,35 @@ func (table *CacheTable) SetDataLoader(f func(interface{}, ...interface{}) *Cach
 	table.loadData = f
 }
 
+// SetNegativeTTL configures how long to remember keys the data-loader callback
+// couldn't load. Until then, Value returns ErrNegativeCached for such keys
+// instead of calling the data-loader again. Apart from that, remembered keys
+// are treated as absent. A duration of 0 disables this.
+func (table *CacheTable) SetNegativeTTL(d time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	table.negativeTTL = d
+}
+
+// SetDataLoadedCallback configures a callback, which will be called every
+// time an item fetched by the data-loader callback is added to the cache.
+// Unlike the added item callbacks, it isn't called for items added otherwise.
+func (table *CacheTable) SetDataLoadedCallback(f func(*CacheItem)) {
+	table.Lock()
+	defer table.Unlock()
+	table.dataLoaded = f
+}
+
+// SetCloneOnRead configures a callback, which will be used to copy an item's
+// data whenever it gets returned by Value. Value then returns a copy of the
+// item, so callers modifying the data don't affect the cached item. Pass nil
+// to return the cached items themselves again.
+func (table *CacheTable) SetCloneOnRead(f func(interface{}) interface{}) {
+	table.Lock()
+	defer table.Unlock()
+	table.cloneOnRead = f
+}
+
 // SetAddedItemCallback configures a callback, which will be called every time
 // a new item is added to the cache.
 func (table *CacheTable) SetAddedItemCallback(f func(*CacheItem)) {
@@ -92,6 +288,38 @@ func (table *CacheTable) RemoveAddedItemCallbacks() {
 	table.addedItem = nil
 }
 
+// SetOverwriteCallback configures a callback, which will be called with the
+// previous and the new item whenever adding an item replaces an existing one
+// with the same key. This allows releasing resources held by the old item.
+func (table *CacheTable) SetOverwriteCallback(f func(old, new *CacheItem)) {
+	table.Lock()
+	defer table.Unlock()
+	table.overwritten = f
+}
+
+// SetMissCallback configures a callback, which will be called with the key
+// whenever Value doesn't find an item, before the data-loader callback runs.
+func (table *CacheTable) SetMissCallback(f func(key interface{})) {
+	table.Lock()
+	defer table.Unlock()
+	table.missed = f
+}
+
+// AddAccessCallback appends a new callback to the accessedItem queue, which
+// will be called every time an item is found by Value.
+func (table *CacheTable) AddAccessCallback(f func(*CacheItem)) {
+	table.Lock()
+	defer table.Unlock()
+	table.accessedItem = append(table.accessedItem, f)
+}
+
+// RemoveAccessCallbacks empties the accessed item callback queue
+func (table *CacheTable) RemoveAccessCallbacks() {
+	table.Lock()
+	defer table.Unlock()
+	table.accessedItem = nil
+}
+
 // SetAboutToDeleteItemCallback configures a callback, which will be called
 // every time an item is about to be removed from the cache.
 func (table *CacheTable) SetAboutToDeleteItemCallback(f func(*CacheItem)) {
@@ -117,6 +345,15 @@ func (table *CacheTable) RemoveAboutToDeleteItemCallback() {
 	table.aboutToDeleteItem = nil
 }
 
+// SetCleanupCallback configures a callback, which will be called after every
+// expiration check with the number of expired items it removed and how long
+// the check took.
+func (table *CacheTable) SetCleanupCallback(f func(removed int, duration time.Duration)) {
+	table.Lock()
+	defer table.Unlock()
+	table.cleanedUp = f
+}
+
 // SetLogger sets the logger to be used by this cache table.
 func (table *CacheTable) SetLogger(logger *log.Logger) {
 	table.Lock()
@@ -124,8 +361,177 @@ func (table *CacheTable) SetLogger(logger *log.Logger) {
 	table.logger = logger
 }
 
-// Expiration check loop, triggered by a self-adjusting timer.
-func (table *CacheTable) expirationCheck() {
+// SetKeepAliveOnAccess configures whether accessing an item via Value keeps it
+// alive for another lifespan. When disabled, items expire once their lifespan
+// has passed since they were added, no matter how often they get accessed.
+func (table *CacheTable) SetKeepAliveOnAccess(keepAlive bool) {
+	table.Lock()
+	table.expireByCreateTime = !keepAlive
+	if table.expiryHeap != nil {
+		table.rebuildExpiryHeapInternal()
+	}
+	table.Unlock()
+
+	// The items' remaining lifespans changed, so re-schedule the timer.
+	table.expirationCheck()
+}
+
+// EvictionChan returns a channel receiving every item which expires or gets
+// evicted to stay within the table's limits. Items are dropped instead of
+// blocking the table when the channel's buffer is full. Every call returns a
+// new channel; all of them get closed by Stop.
+func (table *CacheTable) EvictionChan(buffer int) <-chan *CacheItem {
+	ch := make(chan *CacheItem, buffer)
+
+	table.Lock()
+	defer table.Unlock()
+	table.evictionChans = append(table.evictionChans, ch)
+
+	return ch
+}
+
+// Freeze makes this cache table read-only until Unfreeze gets called, e.g.
+// for a consistent export. While frozen, methods adding, updating or deleting
+// items return ErrTableFrozen, or nil, false or 0 if they don't return an
+// error. Reading items, Flush and the expiration check keep working.
+func (table *CacheTable) Freeze() {
+	table.Lock()
+	defer table.Unlock()
+	table.frozen = true
+}
+
+// Unfreeze makes this cache table writable again after Freeze.
+func (table *CacheTable) Unfreeze() {
+	table.Lock()
+	defer table.Unlock()
+	table.frozen = false
+}
+
+// SetLazyExpiration makes Value remove items which exceeded their lifespan
+// but haven't been removed by the expiration check yet, and return
+// ErrKeyNotFound for them. This bounds how long expired items can be read, at
+// the cost of checking every item's lifespan on access.
+func (table *CacheTable) SetLazyExpiration(lazy bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.lazyExpiration = lazy
+}
+
+// SetCleanupJitter delays each run of the expiration timer by a random
+// fraction of its interval, up to the given fraction (e.g. 0.1 for at most
+// 10%). This keeps many tables from cleaning up at the same time, at the cost
+// of expired items lingering a little longer. 0 disables the jitter.
+func (table *CacheTable) SetCleanupJitter(fraction float64) {
+	if fraction < 0 {
+		fraction = 0
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	table.cleanupJitter = fraction
+}
+
+// SetMaxItems limits how many items this cache table holds. Whenever the limit
+// gets exceeded, the least recently accessed items are removed from the cache.
+// A limit of 0 disables the limit.
+func (table *CacheTable) SetMaxItems(maxItems int) {
+	table.Lock()
+	defer table.Unlock()
+	table.maxItems = maxItems
+	table.updateLRUInternal()
+	table.evictInternal()
+}
+
+// SetMaxBytes limits the total size of all items in this cache table, as
+// reported by the sizeOf callback. Whenever the limit gets exceeded, the least
+// recently accessed items are removed from the cache. A limit of 0 disables
+// the limit. sizeOf gets called with the table locked and must not access it.
+func (table *CacheTable) SetMaxBytes(maxBytes int64, sizeOf func(*CacheItem) int64) {
+	table.Lock()
+	defer table.Unlock()
+	table.maxBytes = maxBytes
+	table.sizeOf = sizeOf
+
+	total := int64(0)
+	for _, item := range table.items {
+		total += table.sizeOfInternal(item)
+	}
+	atomic.StoreInt64(&table.bytes, total)
+	table.updateLRUInternal()
+	table.evictInternal()
+}
+
+// SetHeapThreshold enables evicting items under memory pressure. Whenever
+// the allocated heap exceeds heapThreshold bytes after adding items, a tenth
+// of this table's items get evicted, lowest priority and least recently
+// accessed first, see AddWithPriority. The items just added are never
+// evicted. Reading the heap size briefly stops the world, so it's checked at
+// most once per second. A threshold of 0 disables it.
+func (table *CacheTable) SetHeapThreshold(heapThreshold uint64) {
+	table.Lock()
+	defer table.Unlock()
+	table.heapThreshold = heapThreshold
+	table.updateLRUInternal()
+}
+
+// EstimateBytes returns roughly how much memory this cache table uses, by
+// summing sizeOf over all items plus a fixed overhead per item for the item
+// itself and its map entry. Unlike Bytes, this scans the whole table and
+// works without SetMaxBytes. sizeOf may be nil to only count the overhead.
+func (table *CacheTable) EstimateBytes(sizeOf func(*CacheItem) int64) int64 {
+	table.RLock()
+	defer table.RUnlock()
+
+	total := int64(len(table.items)) * itemOverhead
+	if sizeOf != nil {
+		for _, item := range table.items {
+			total += sizeOf(item)
+		}
+	}
+
+	return total
+}
+
+// Bytes returns the total size of all items in this cache table, as reported
+// by the callback configured with SetMaxBytes.
+func (table *CacheTable) Bytes() int64 {
+	return atomic.LoadInt64(&table.bytes)
+}
+
+// SetLockContentionTracking enables counting how often Add and Value find the
+// table locked and have to wait, see Metrics. This makes both slightly more
+// expensive, so it's disabled by default.
+func (table *CacheTable) SetLockContentionTracking(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&table.countContention, v)
+}
+
+// Healthy reports whether this table's expiration checks run in time. It
+// returns false once a scheduled check is overdue by several timer
+// intervals, e.g. because a callback blocks it. Healthy never waits for the
+// table lock, so it can be used as a liveness probe.
+func (table *CacheTable) Healthy() bool {
+	deadline := atomic.LoadInt64(&table.checkDeadline)
+	return deadline == 0 || time.Now().UnixNano() < deadline
+}
+
+// ReapNow immediately removes all expired items, instead of waiting for the
+// expiration timer, and returns how many items it removed.
+func (table *CacheTable) ReapNow() int {
+	return len(table.expirationCheck())
+}
+
+// ReapNowKeys works like ReapNow, but returns the keys of the removed items.
+func (table *CacheTable) ReapNowKeys() []interface{} {
+	return table.expirationCheck()
+}
+
+// Expiration check loop, triggered by a self-adjusting timer. Returns the keys
+// of the expired items which were removed.
+func (table *CacheTable) expirationCheck() []interface{} {
 	table.Lock()
 	if table.cleanupTimer != nil {
 		table.cleanupTimer.Stop()
@@ -140,27 +546,45 @@ func (table *CacheTable) expirationCheck() {
 	// loop iteration. Not sure it's really efficient though.
 	now := time.Now()
 	smallestDuration := 0 * time.Second
-	for key, item := range table.items {
-		// Cache values so we don't keep blocking the mutex.
-		item.RLock()
-		lifeSpan := item.lifeSpan
-		checkTime := item.accessedOn
-		if table.expireByCreateTime {
-			checkTime = item.createdOn
-		}
-		//accessedOn := item.accessedOn
-		item.RUnlock()
-
-		if lifeSpan == 0 {
-			continue
+	var deleteList []*CacheItem
+	if table.expiryHeap != nil {
+		deleteList, smallestDuration = table.popExpiredInternal(now)
+	} else {
+		for _, item := range table.items {
+			remaining, expires := table.expiresIn(item, now)
+			if !expires {
+				continue
+			}
+			if remaining <= 0 {
+				// Item has excessed its lifespan. Deleting it temporarily
+				// unlocks the table, so don't do that while iterating.
+				deleteList = append(deleteList, item)
+			} else {
+				// Find the item chronologically closest to its end-of-lifespan.
+				if smallestDuration == 0 || remaining < smallestDuration {
+					smallestDuration = remaining
+				}
+			}
 		}
-		if now.Sub(checkTime) >= lifeSpan {
-			// Item has excessed its lifespan.
-			table.deleteInternal(key)
-		} else {
-			// Find the item chronologically closest to its end-of-lifespan.
-			if smallestDuration == 0 || lifeSpan-now.Sub(checkTime) < smallestDuration {
-				smallestDuration = lifeSpan - now.Sub(checkTime)
+	}
+	for key, until := range table.negatives {
+		if remaining := until.Sub(now); remaining <= 0 {
+			delete(table.negatives, key)
+		} else if smallestDuration == 0 || remaining < smallestDuration {
+			smallestDuration = remaining
+		}
+	}
+	var removed []interface{}
+	for _, item := range deleteList {
+		if table.expireItemInternal(item) {
+			removed = append(removed, item.key)
+			atomic.AddInt64(&table.expirations, 1)
+			table.publishEvictionInternal(item)
+		} else if table.items[item.key] == item {
+			// A callback kept the item, so check it again once its
+			// restarted lifespan is over.
+			if lifeSpan := item.LifeSpan(); smallestDuration == 0 || lifeSpan < smallestDuration {
+				smallestDuration = lifeSpan
 			}
 		}
 	}
@@ -168,33 +592,87 @@ func (table *CacheTable) expirationCheck() {
 	// Setup the interval for the next cleanup run.
 	table.cleanupInterval = smallestDuration
 	if smallestDuration > 0 {
-		table.cleanupTimer = time.AfterFunc(smallestDuration, func() {
+		delay := smallestDuration
+		if table.cleanupJitter > 0 {
+			delay += time.Duration(rand.Float64() * table.cleanupJitter * float64(smallestDuration))
+		}
+		table.cleanupTimer = time.AfterFunc(delay, func() {
 			go table.expirationCheck()
 		})
+
+		deadline := now.Add(healthyIntervals * delay)
+		if min := now.Add(delay + time.Second); deadline.Before(min) {
+			deadline = min
+		}
+		atomic.StoreInt64(&table.checkDeadline, deadline.UnixNano())
+	} else {
+		atomic.StoreInt64(&table.checkDeadline, 0)
 	}
+
+	// Cache value so we don't keep blocking the mutex.
+	cleanedUp := table.cleanedUp
 	table.Unlock()
+
+	// Trigger callback after the expiration check finished.
+	if cleanedUp != nil {
+		cleanedUp(len(removed), time.Since(now))
+	}
+
+	return removed
 }
 
-func (table *CacheTable) addInternal(item *CacheItem) {
+func (table *CacheTable) addInternal(items ...*CacheItem) {
 	// Careful: do not run this method unless the table-mutex is locked!
 	// It will unlock it for the caller before running the callbacks and checks
-	table.log("Adding item with key", item.key, "and lifespan of", item.lifeSpan, "to table", table.name)
-	table.items[item.key] = item
+	smallestLifeSpan := 0 * time.Second
+	var replaced [][2]*CacheItem
+	for _, item := range items {
+		table.log("Adding item with key", item.key, "and lifespan of", item.lifeSpan, "to table", table.name)
+		if old, ok := table.items[item.key]; ok {
+			table.untrackInternal(old)
+			atomic.AddInt64(&table.bytes, -table.sizeOfInternal(old))
+			item.overwrote = true
+			replaced = append(replaced, [2]*CacheItem{old, item})
+		}
+		table.items[item.key] = item
+		table.trackInternal(item)
+		delete(table.negatives, item.key)
+		atomic.AddInt64(&table.bytes, table.sizeOfInternal(item))
+		table.scheduleInternal(item)
+		table.wakeWaitersInternal(item)
+
+		if item.lifeSpan > 0 && (smallestLifeSpan == 0 || item.lifeSpan < smallestLifeSpan) {
+			smallestLifeSpan = item.lifeSpan
+		}
+	}
+	atomic.AddInt64(&table.adds, int64(len(items)))
+	table.evictInternal()
+	table.relieveMemoryPressureInternal(items)
 
 	// Cache values so we don't keep blocking the mutex.
 	expDur := table.cleanupInterval
 	addedItem := table.addedItem
+	overwritten := table.overwritten
 	table.Unlock()
 
+	// Trigger callback after replacing an item in the cache.
+	if overwritten != nil {
+		for _, pair := range replaced {
+			overwritten(pair[0], pair[1])
+		}
+	}
+
 	// Trigger callback after adding an item to cache.
 	if addedItem != nil {
-		for _, callback := range addedItem {
-			callback(item)
+		for _, item := range items {
+			for _, callback := range addedItem {
+				callback(item)
+			}
 		}
 	}
 
 	// If we haven't set up any expiration check timer or found a more imminent item.
-	if item.lifeSpan > 0 && (expDur == 0 || item.lifeSpan < expDur) {
+	if smallestLifeSpan > 0 && (expDur == 0 || smallestLifeSpan < expDur) {
 		table.expirationCheck()
 	}
 }
@@ -208,122 +686,1066 @@ func (table *CacheTable) Add(key interface{}, lifeSpan time.Duration, data inter
 	item := NewCacheItem(key, lifeSpan, data)
 
 	// Add item to cache.
-	table.Lock()
+	table.lockCounted()
+	if table.frozen {
+		table.Unlock()
+		return nil
+	}
 	table.addInternal(item)
 
 	return item
 }
 
-func (table *CacheTable) deleteInternal(key interface{}) (*CacheItem, error) {
-	r, ok := table.items[key]
-	if !ok {
-		return nil, ErrKeyNotFound
-	}
-
-	// Cache value so we don't keep blocking the mutex.
-	aboutToDeleteItem := table.aboutToDeleteItem
-	table.Unlock()
-
-	// Trigger callbacks before deleting an item from cache.
-	if aboutToDeleteItem != nil {
-		for _, callback := range aboutToDeleteItem {
-			callback(r)
-		}
-	}
-
-	r.RLock()
-	defer r.RUnlock()
-	if r.aboutToExpire != nil {
-		for _, callback := range r.aboutToExpire {
-			callback(key)
-		}
-	}
+// AddReturningOld works like Add, but returns the item previously stored for
+// key, if any. Looking up the old item and adding the new one happens while
+// the table is locked, so no other write can slip in between.
+func (table *CacheTable) AddReturningOld(key interface{}, lifeSpan time.Duration, data interface{}) (old *CacheItem, replaced bool) {
+	item := NewCacheItem(key, lifeSpan, data)
 
 	table.Lock()
-	table.log("Deleting item with key", key, "created on", r.createdOn, "and hit", r.accessCount, "times from table", table.name)
-	delete(table.items, key)
+	if table.frozen {
+		table.Unlock()
+		return nil, false
+	}
+	old, replaced = table.items[key]
+	table.addInternal(item)
 
-	return r, nil
+	return old, replaced
 }
 
-// Delete an item from the cache.
-func (table *CacheTable) Delete(key interface{}) (*CacheItem, error) {
+// AddWithExpiry adds a key/value pair to the cache, which expires at the given
+// time no matter how often it gets accessed, see
+// NewCacheItemWithAbsoluteExpiry.
+func (table *CacheTable) AddWithExpiry(key interface{}, expiresAt time.Time, data interface{}) *CacheItem {
+	item := NewCacheItemWithAbsoluteExpiry(key, expiresAt, data)
+
 	table.Lock()
-	defer table.Unlock()
+	if table.frozen {
+		table.Unlock()
+		return nil
+	}
+	table.addInternal(item)
 
-	return table.deleteInternal(key)
+	return item
 }
 
-// Exists returns whether an item exists in the cache. Unlike the Value method
-// Exists neither tries to fetch data via the loadData callback nor does it
-// keep the item alive in the cache.
-func (table *CacheTable) Exists(key interface{}) bool {
-	table.RLock()
-	defer table.RUnlock()
-	_, ok := table.items[key]
-
-	return ok
-}
+// AddWithPolicy works like Add, but counts the item's lifespan according to
+// the given policy instead of the table's expiration mode.
+func (table *CacheTable) AddWithPolicy(key interface{}, lifeSpan time.Duration, data interface{}, policy ExpirationPolicy) *CacheItem {
+	item := NewCacheItem(key, lifeSpan, data)
+	item.policy = policy
 
-// NotFoundAdd checks whether an item is not yet cached. Unlike the Exists
-// method this also adds data if the key could not be found.
-func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool {
 	table.Lock()
-
-	if _, ok := table.items[key]; ok {
+	if table.frozen {
 		table.Unlock()
-		return false
+		return nil
 	}
-
-	item := NewCacheItem(key, lifeSpan, data)
 	table.addInternal(item)
 
-	return true
+	return item
 }
 
-// Value returns an item from the cache and marks it to be kept alive. You can
-// pass additional arguments to your DataLoader callback function.
-func (table *CacheTable) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
-	table.RLock()
-	r, ok := table.items[key]
-	loadData := table.loadData
-	table.RUnlock()
+// WaitForKey returns the item with the given key, waiting until it gets added
+// if it doesn't exist yet. It returns ctx.Err() if ctx is done before that.
+// Unlike Value, it neither calls the data-loader nor counts as an access.
+func (table *CacheTable) WaitForKey(ctx context.Context, key interface{}) (*CacheItem, error) {
+	table.Lock()
+	if r, ok := table.items[key]; ok {
+		table.Unlock()
+		return r, nil
+	}
+	ch := make(chan *CacheItem, 1)
+	if table.waiters == nil {
+		table.waiters = make(map[interface{}][]chan *CacheItem)
+	}
+	table.waiters[key] = append(table.waiters[key], ch)
+	table.Unlock()
 
-	if ok {
-		// Update access counter and timestamp.
-		r.KeepAlive()
+	select {
+	case r := <-ch:
 		return r, nil
+	case <-ctx.Done():
 	}
 
-	// Item doesn't exist in cache. Try and fetch it with a data-loader.
-	if loadData != nil {
-		item := loadData(key, args...)
-		if item != nil {
-			table.Add(key, item.lifeSpan, item.data)
-			return item, nil
+	table.Lock()
+	defer table.Unlock()
+	waiters := table.waiters[key]
+	for i, c := range waiters {
+		if c == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
 		}
-
-		return nil, ErrKeyNotFoundOrLoadable
+	}
+	if len(waiters) == 0 {
+		delete(table.waiters, key)
+	} else {
+		table.waiters[key] = waiters
 	}
 
-	return nil, ErrKeyNotFound
+	return nil, ctx.Err()
 }
 
-// Flush deletes all items from this cache table.
-func (table *CacheTable) Flush() {
-	table.Lock()
-	defer table.Unlock()
+// wakeWaitersInternal hands a newly added item to all goroutines waiting for
+// its key.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) wakeWaitersInternal(item *CacheItem) {
+	for _, ch := range table.waiters[item.key] {
+		ch <- item
+	}
+	delete(table.waiters, item.key)
+}
 
-	table.log("Flushing table", table.name)
+// AddChecked works like Add, but instead of evicting other items it returns
+// ErrCacheFull if adding the item would exceed the limits configured with
+// SetMaxItems or SetMaxBytes. Replacing an existing item only counts the
+// difference in size.
+func (table *CacheTable) AddChecked(key interface{}, lifeSpan time.Duration, data interface{}) (*CacheItem, error) {
+	item := NewCacheItem(key, lifeSpan, data)
 
-	table.items = make(map[interface{}]*CacheItem)
-	table.cleanupInterval = 0
-	if table.cleanupTimer != nil {
-		table.cleanupTimer.Stop()
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		return nil, ErrTableFrozen
 	}
+	old, exists := table.items[key]
+	if table.maxItems > 0 && !exists && len(table.items) >= table.maxItems {
+		table.Unlock()
+		return nil, ErrCacheFull
+	}
+	if table.maxBytes > 0 {
+		bytes := atomic.LoadInt64(&table.bytes) + table.sizeOfInternal(item)
+		if exists {
+			bytes -= table.sizeOfInternal(old)
+		}
+		if bytes > table.maxBytes {
+			table.Unlock()
+			return nil, ErrCacheFull
+		}
+	}
+	table.addInternal(item)
+
+	return item, nil
 }
 
-// CacheItemPair maps key to access counter
+// AddWithPriority works like Add, but sets the item's eviction priority.
+// When the table exceeds its limits or the heap threshold, items with a lower
+// priority get evicted before items with a higher one. Add uses priority 0.
+func (table *CacheTable) AddWithPriority(key interface{}, lifeSpan time.Duration, data interface{}, priority int) *CacheItem {
+	item := NewCacheItem(key, lifeSpan, data)
+	item.priority = priority
+
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		return nil
+	}
+	table.addInternal(item)
+
+	return item
+}
+
+// AddBatch adds all given key/value pairs to the cache, using the same
+// lifespan for each of them. Unlike calling Add repeatedly, this only locks
+// the table once.
+func (table *CacheTable) AddBatch(items map[interface{}]interface{}, lifeSpan time.Duration) {
+	batch := make([]*CacheItem, 0, len(items))
+	for key, data := range items {
+		batch = append(batch, NewCacheItem(key, lifeSpan, data))
+	}
+
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		return
+	}
+	table.addInternal(batch...)
+}
+
+// deleteInternal deletes the item with the given key after running the
+// callbacks. When expiring is true and an about-to-expire callback vetoes,
+// the item's lifespan starts over instead and errExpirationVetoed is returned.
+// Careful: do not run this method unless the table-mutex is locked!
+// It will unlock it while running the callbacks and lock it again.
+func (table *CacheTable) deleteInternal(key interface{}, expiring bool) (*CacheItem, error) {
+	r, ok := table.items[key]
+	if !ok || r.deleting {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+	// Make sure concurrent deletes of this item fail while the table is
+	// unlocked for the callbacks.
+	r.deleting = true
+
+	// Cache value so we don't keep blocking the mutex.
+	aboutToDeleteItem := table.aboutToDeleteItem
+	table.Unlock()
+
+	r.RLock()
+	aboutToExpire := r.aboutToExpire
+	r.RUnlock()
+	if expiring {
+		// Give the item's callbacks a chance to keep it before anything
+		// else learns about the deletion.
+		vetoed := false
+		for _, callback := range aboutToExpire {
+			if callback(key) {
+				vetoed = true
+			}
+		}
+		if vetoed {
+			table.Lock()
+			r.deleting = false
+			if table.items[key] == r {
+				table.log("Keeping expired item with key", key, "in table", table.name)
+				table.restartLifeSpan(r)
+			}
+			return r, errExpirationVetoed
+		}
+	}
+
+	// Trigger callbacks before deleting an item from cache.
+	if aboutToDeleteItem != nil {
+		for _, callback := range aboutToDeleteItem {
+			callback(r)
+		}
+	}
+
+	if !expiring {
+		for _, callback := range aboutToExpire {
+			callback(key)
+		}
+	}
+
+	table.Lock()
+	// The item might have been replaced while the table was unlocked.
+	if table.items[key] == r {
+		table.log("Deleting item with key", key, "created on", r.CreatedOn(), "and hit", r.AccessCount(), "times from table", table.name)
+		delete(table.items, key)
+		table.untrackInternal(r)
+		atomic.AddInt64(&table.bytes, -table.sizeOfInternal(r))
+	}
+
+	return r, nil
+}
+
+// deleteItemInternal deletes an item unless it got replaced or deleted in the
+// meantime, and returns whether it did.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) deleteItemInternal(item *CacheItem) bool {
+	if table.items[item.key] != item {
+		return false
+	}
+	_, err := table.deleteInternal(item.key, false)
+	return err == nil
+}
+
+// expireItemInternal works like deleteItemInternal, but lets the item's
+// about-to-expire callbacks veto the deletion.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) expireItemInternal(item *CacheItem) bool {
+	if table.items[item.key] != item {
+		return false
+	}
+	_, err := table.deleteInternal(item.key, true)
+	return err == nil
+}
+
+// Delete an item from the cache and return it. When several goroutines delete
+// the same item concurrently, only one of them succeeds, so Delete can be used
+// to fetch and remove an item in a single step.
+func (table *CacheTable) Delete(key interface{}) (*CacheItem, error) {
+	table.Lock()
+	defer table.Unlock()
+	if table.frozen {
+		return nil, ErrTableFrozen
+	}
+
+	r, err := table.deleteInternal(key, false)
+	if err == nil {
+		atomic.AddInt64(&table.deletes, 1)
+	}
+	return r, err
+}
+
+// DeleteBatch deletes all given keys from the cache and returns how many of
+// them existed. Unlike calling Delete repeatedly, this only locks the table
+// once, apart from running the callbacks.
+func (table *CacheTable) DeleteBatch(keys []interface{}) int {
+	table.Lock()
+	defer table.Unlock()
+	if table.frozen {
+		return 0
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if _, err := table.deleteInternal(key, false); err == nil {
+			deleted++
+		}
+	}
+	atomic.AddInt64(&table.deletes, int64(deleted))
+
+	return deleted
+}
+
+// DeleteFunc deletes all items for which match returns true and returns how
+// many were deleted. match is called without holding the table lock, so it
+// may safely access the table itself.
+func (table *CacheTable) DeleteFunc(match func(key interface{}, item *CacheItem) bool) int {
+	var matches []*CacheItem
+	table.Foreach(func(key interface{}, item *CacheItem) {
+		if match(key, item) {
+			matches = append(matches, item)
+		}
+	})
+
+	table.Lock()
+	defer table.Unlock()
+	if table.frozen {
+		return 0
+	}
+
+	deleted := 0
+	for _, item := range matches {
+		if table.deleteItemInternal(item) {
+			deleted++
+		}
+	}
+	atomic.AddInt64(&table.deletes, int64(deleted))
+
+	return deleted
+}
+
+// Exists returns whether an item exists in the cache. Unlike the Value method
+// Exists neither tries to fetch data via the loadData callback nor does it
+// keep the item alive in the cache.
+func (table *CacheTable) Exists(key interface{}) bool {
+	table.RLock()
+	defer table.RUnlock()
+	_, ok := table.items[key]
+
+	return ok
+}
+
+// NotFoundAdd checks whether an item is not yet cached. Unlike the Exists
+// method this also adds data if the key could not be found.
+func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool {
+	table.Lock()
+
+	if _, ok := table.items[key]; ok || table.frozen {
+		table.Unlock()
+		return false
+	}
+
+	item := NewCacheItem(key, lifeSpan, data)
+	table.addInternal(item)
+
+	return true
+}
+
+// GetOrAdd returns the item stored for key and marks it to be kept alive. If
+// the key does not exist yet, create is called to produce the item's data,
+// which then gets added with the given lifespan. The table stays locked while
+// create runs, so concurrent callers never create the same key twice, but
+// create must not access the table itself. The returned bool reports whether
+// the item was newly created.
+func (table *CacheTable) GetOrAdd(key interface{}, lifeSpan time.Duration, create func() interface{}) (*CacheItem, bool) {
+	table.Lock()
+
+	if r, ok := table.items[key]; ok {
+		table.Unlock()
+		r.KeepAlive()
+		return r, false
+	}
+	if table.frozen {
+		table.Unlock()
+		return nil, false
+	}
+
+	item := NewCacheItem(key, lifeSpan, create())
+	table.addInternal(item)
+
+	return item, true
+}
+
+// Increment adds delta to the int64 value stored for key and returns the
+// result. If the key does not exist yet, it gets added with the given lifespan
+// and delta as its initial value. ErrTypeMismatch is returned if the stored
+// value is not an int64.
+func (table *CacheTable) Increment(key interface{}, delta int64, lifeSpan time.Duration) (int64, error) {
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		return 0, ErrTableFrozen
+	}
+
+	r, ok := table.items[key]
+	if !ok {
+		table.addInternal(NewCacheItem(key, lifeSpan, delta))
+		return delta, nil
+	}
+	defer table.Unlock()
+
+	n, ok := r.Data().(int64)
+	if !ok {
+		return 0, ErrTypeMismatch
+	}
+	n += delta
+	table.setDataInternal(r, n)
+
+	return n, nil
+}
+
+// UpdateData replaces the data of the item stored for key, keeping its
+// lifespan and expiration clock. Returns ErrKeyNotFound if the key does not
+// exist.
+func (table *CacheTable) UpdateData(key interface{}, data interface{}) error {
+	table.Lock()
+	defer table.Unlock()
+	if table.frozen {
+		return ErrTableFrozen
+	}
+
+	r, ok := table.items[key]
+	if !ok {
+		return &KeyNotFoundError{Key: key}
+	}
+	table.setDataInternal(r, data)
+
+	return nil
+}
+
+// SetLifeSpan changes the lifespan of the item stored for key and restarts its
+// expiration clock. An absolute expiry of the item gets dropped. Returns
+// ErrKeyNotFound if the key does not exist.
+func (table *CacheTable) SetLifeSpan(key interface{}, lifeSpan time.Duration) error {
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		return ErrTableFrozen
+	}
+
+	r, ok := table.items[key]
+	if !ok {
+		table.Unlock()
+		return &KeyNotFoundError{Key: key}
+	}
+	table.setLifeSpanInternal(r, lifeSpan)
+
+	return nil
+}
+
+// Replace replaces the data and lifespan of the item stored for key and
+// restarts its expiration clock, returning true. Unlike Add, it never creates
+// an item and returns false if the key does not exist.
+func (table *CacheTable) Replace(key interface{}, lifeSpan time.Duration, data interface{}) (bool, error) {
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		return false, ErrTableFrozen
+	}
+
+	r, ok := table.items[key]
+	if !ok {
+		table.Unlock()
+		return false, nil
+	}
+	table.setDataInternal(r, data)
+	table.setLifeSpanInternal(r, lifeSpan)
+
+	return true, nil
+}
+
+// CompareAndSwap replaces the data of the item stored for key with new, but
+// only if its current data is deeply equal to old. On success, the item also
+// gets the given lifespan and its expiration clock is restarted. Returns
+// whether the data got replaced, or ErrKeyNotFound if the key does not exist.
+func (table *CacheTable) CompareAndSwap(key interface{}, old, new interface{}, lifeSpan time.Duration) (bool, error) {
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		return false, ErrTableFrozen
+	}
+
+	r, ok := table.items[key]
+	if !ok {
+		table.Unlock()
+		return false, &KeyNotFoundError{Key: key}
+	}
+	if !reflect.DeepEqual(r.Data(), old) {
+		table.Unlock()
+		return false, nil
+	}
+	table.setDataInternal(r, new)
+	table.setLifeSpanInternal(r, lifeSpan)
+
+	return true, nil
+}
+
+// Touch restarts the expiration clock of the item stored for key, keeping its
+// lifespan. Unlike Value, this doesn't count as an access of the item.
+// Returns ErrKeyNotFound if the key does not exist, or ErrTableFrozen.
+func (table *CacheTable) Touch(key interface{}) error {
+	table.Lock()
+	defer table.Unlock()
+	if table.frozen {
+		return ErrTableFrozen
+	}
+
+	r, ok := table.items[key]
+	if !ok {
+		return &KeyNotFoundError{Key: key}
+	}
+	table.restartLifeSpan(r)
+
+	return nil
+}
+
+// TTL returns how long the item stored for key has left until it expires, or
+// -1 if it never expires. Returns ErrKeyNotFound if the key does not exist.
+func (table *CacheTable) TTL(key interface{}) (time.Duration, error) {
+	table.RLock()
+	defer table.RUnlock()
+
+	r, ok := table.items[key]
+	if !ok {
+		return 0, &KeyNotFoundError{Key: key}
+	}
+	remaining, expires := table.expiresIn(r, time.Now())
+	if !expires {
+		return -1, nil
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return remaining, nil
+}
+
+// Value returns an item from the cache and marks it to be kept alive. You can
+// pass additional arguments to your DataLoader callback function.
+func (table *CacheTable) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
+	return table.ValueCtx(context.Background(), key, args...)
+}
+
+// Peek returns an item from the cache like Value, but without counting as an
+// access: the item's access count, access time and lifespan stay untouched,
+// no callbacks or statistics are updated and the data-loader isn't called.
+func (table *CacheTable) Peek(key interface{}) (*CacheItem, error) {
+	table.RLock()
+	r, ok := table.items[key]
+	cloneOnRead := table.cloneOnRead
+	table.RUnlock()
+
+	if !ok {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+	if cloneOnRead != nil {
+		return r.cloneWith(cloneOnRead(r.Data())), nil
+	}
+	return r, nil
+}
+
+// ValueOrDefault returns the data of an item from the cache, or def if the
+// lookup via Value fails for any reason.
+func (table *CacheTable) ValueOrDefault(key, def interface{}) interface{} {
+	item, err := table.Value(key)
+	if err != nil {
+		return def
+	}
+	return item.Data()
+}
+
+// ValueCtx works like Value, but returns ctx.Err() if ctx is done before the
+// lookup or while waiting for the DataLoader callback. An item the callback
+// returns after that still gets added to the cache. To let the callback itself
+// abort, pass ctx as one of the additional arguments.
+func (table *CacheTable) ValueCtx(ctx context.Context, key interface{}, args ...interface{}) (*CacheItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	table.rLockCounted()
+	return table.valueInternal(ctx, key, args...)
+}
+
+// ValueFresh works like Value, but returns ErrKeyNotFound for items which
+// already exceeded their lifespan and just haven't been removed by the
+// expiration check yet.
+func (table *CacheTable) ValueFresh(key interface{}) (*CacheItem, error) {
+	table.RLock()
+	if r, ok := table.items[key]; ok && !table.lazyExpiration && table.staleInternal(r, time.Now()) {
+		missed := table.missed
+		table.RUnlock()
+		atomic.AddInt64(&table.misses, 1)
+		if missed != nil {
+			missed(key)
+		}
+		return nil, &KeyNotFoundError{Key: key}
+	}
+
+	return table.valueInternal(context.Background(), key)
+}
+
+// ValueTimeout works like Value, but gives up waiting for the table lock after
+// d and returns ErrLockTimeout then, e.g. while a slow callback holds the lock.
+// Waiting for the DataLoader callback counts towards d as well. With lazy
+// expiration, an expired item is reported missing once d passed, even if it
+// couldn't be removed yet.
+func (table *CacheTable) ValueTimeout(key interface{}, d time.Duration, args ...interface{}) (*CacheItem, error) {
+	deadline := time.Now().Add(d)
+	for !table.TryRLock() {
+		if !time.Now().Before(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return table.valueInternal(ctx, key, args...)
+}
+
+// valueInternal looks up an item for ValueCtx and ValueTimeout.
+// Careful: do not run this method unless the table-mutex is read-locked!
+// It will unlock it before running the callbacks.
+func (table *CacheTable) valueInternal(ctx context.Context, key interface{}, args ...interface{}) (*CacheItem, error) {
+	r, ok := table.items[key]
+	if ok && table.lazyExpiration && table.staleInternal(r, time.Now()) {
+		missed := table.missed
+		table.RUnlock()
+		if !table.lockBefore(ctx) {
+			// No time left to remove the item, but it expired all the
+			// same, so leave that to the expiration check.
+			atomic.AddInt64(&table.misses, 1)
+			if missed != nil {
+				missed(key)
+			}
+			return nil, &KeyNotFoundError{Key: key}
+		}
+		if table.expireItemInternal(r) {
+			atomic.AddInt64(&table.expirations, 1)
+			table.publishEvictionInternal(r)
+			missed := table.missed
+			table.Unlock()
+			atomic.AddInt64(&table.misses, 1)
+			if missed != nil {
+				missed(key)
+			}
+			return nil, &KeyNotFoundError{Key: key}
+		}
+		table.Unlock()
+
+		// A callback kept the item or it got replaced in the meantime.
+		table.RLock()
+		r, ok = table.items[key]
+	}
+	loadData := table.loadData
+	cloneOnRead := table.cloneOnRead
+	accessedItem := table.accessedItem
+	missed := table.missed
+	negative := !ok && time.Now().Before(table.negatives[key])
+	table.RUnlock()
+
+	if ok {
+		atomic.AddInt64(&table.hits, 1)
+		// Update access counter and timestamp.
+		r.KeepAlive()
+
+		// Trigger callbacks after accessing an item.
+		if accessedItem != nil {
+			for _, callback := range accessedItem {
+				callback(r)
+			}
+		}
+		r.RLock()
+		accessed := r.accessed
+		r.RUnlock()
+		for _, callback := range accessed {
+			callback(r)
+		}
+
+		if cloneOnRead != nil {
+			return r.cloneWith(cloneOnRead(r.Data())), nil
+		}
+		return r, nil
+	}
+	atomic.AddInt64(&table.misses, 1)
+
+	// Trigger callback after missing an item.
+	if missed != nil {
+		missed(key)
+	}
+
+	// Item doesn't exist in cache. Try and fetch it with a data-loader.
+	if negative {
+		return nil, ErrNegativeCached
+	}
+	if loadData == nil {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+	if ctx.Done() == nil {
+		// The context can't be canceled, no need to wait in the background.
+		return table.load(loadData, key, args...)
+	}
+
+	type result struct {
+		item *CacheItem
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		item, err := table.load(loadData, key, args...)
+		done <- result{item, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.item, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// load fetches an item via the data-loader callback and adds it to the cache.
+// It returns ErrTableFrozen if the table is frozen by then.
+func (table *CacheTable) load(loadData func(interface{}, ...interface{}) *CacheItem, key interface{}, args ...interface{}) (*CacheItem, error) {
+	item := loadData(key, args...)
+	if item == nil {
+		// Remember that the key couldn't be loaded.
+		table.Lock()
+		negativeTTL := table.negativeTTL
+		if table.frozen {
+			negativeTTL = 0
+		}
+		if negativeTTL > 0 {
+			if table.negatives == nil {
+				table.negatives = make(map[interface{}]time.Time)
+			}
+			table.negatives[key] = time.Now().Add(negativeTTL)
+		}
+		expDur := table.cleanupInterval
+		table.Unlock()
+
+		// Make sure the expiration check forgets the key again.
+		if negativeTTL > 0 && (expDur == 0 || negativeTTL < expDur) {
+			table.expirationCheck()
+		}
+
+		return nil, ErrKeyNotFoundOrLoadable
+	}
+
+	added := NewCacheItem(key, item.lifeSpan, item.data)
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		return nil, ErrTableFrozen
+	}
+	// Cache value so we don't keep blocking the mutex.
+	dataLoaded := table.dataLoaded
+	table.addInternal(added)
+
+	// Trigger callback after adding a loaded item to cache.
+	if dataLoaded != nil {
+		dataLoaded(added)
+	}
+
+	return item, nil
+}
+
+// loadCall is an in-flight call of ValueOrLoad.
+type loadCall struct {
+	wg   sync.WaitGroup
+	item *CacheItem
+	err  error
+}
+
+// ValueOrLoad returns the item stored for key and marks it to be kept alive. On
+// a miss, load is called to fetch the item's data, which then gets added with
+// the given lifespan. Concurrent misses on the same key share a single call to
+// load and its result. The table isn't locked while load runs, so lookups of
+// other keys proceed meanwhile. Errors returned by load are not cached. If the
+// table is frozen, the loaded data is dropped and ErrTableFrozen returned.
+// Every call counts as exactly one hit, if the item was found in the cache, or
+// one miss, if it had to be loaded or waited for.
+func (table *CacheTable) ValueOrLoad(key interface{}, lifeSpan time.Duration, load func() (interface{}, error)) (*CacheItem, error) {
+	table.RLock()
+	r, ok := table.items[key]
+	table.RUnlock()
+
+	if ok {
+		// Update access counter and timestamp.
+		r.KeepAlive()
+		atomic.AddInt64(&table.hits, 1)
+		return r, nil
+	}
+
+	table.loadingMutex.Lock()
+	if c, ok := table.loading[key]; ok {
+		// Another caller is already loading this key, wait for its result.
+		table.loadingMutex.Unlock()
+		atomic.AddInt64(&table.misses, 1)
+		c.wg.Wait()
+		return c.item, c.err
+	}
+	// The key might have been loaded since the lookup above.
+	table.RLock()
+	r, ok = table.items[key]
+	table.RUnlock()
+	if ok {
+		table.loadingMutex.Unlock()
+		r.KeepAlive()
+		atomic.AddInt64(&table.hits, 1)
+		return r, nil
+	}
+	atomic.AddInt64(&table.misses, 1)
+
+	c := &loadCall{}
+	c.wg.Add(1)
+	if table.loading == nil {
+		table.loading = make(map[interface{}]*loadCall)
+	}
+	table.loading[key] = c
+	table.loadingMutex.Unlock()
+
+	defer func() {
+		table.loadingMutex.Lock()
+		delete(table.loading, key)
+		table.loadingMutex.Unlock()
+		c.wg.Done()
+	}()
+
+	data, err := load()
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	item := NewCacheItem(key, lifeSpan, data)
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		c.err = ErrTableFrozen
+		return nil, c.err
+	}
+	table.addInternal(item)
+	c.item = item
+
+	return c.item, nil
+}
+
+// Warmup loads the given keys with up to workers concurrent calls of load and
+// adds every successfully loaded item to the cache. It stops starting new
+// loads once ctx is done and returns ctx.Err() in that case. Otherwise it
+// returns a *WarmupError if load failed for any key.
+func (table *CacheTable) Warmup(ctx context.Context, keys []interface{}, workers int, load func(key interface{}) (interface{}, time.Duration, error)) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var next int64
+	var mu sync.Mutex
+	errs := make(map[interface{}]error)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				n := atomic.AddInt64(&next, 1) - 1
+				if n >= int64(len(keys)) {
+					return
+				}
+
+				key := keys[n]
+				data, lifeSpan, err := load(key)
+				if err != nil {
+					mu.Lock()
+					errs[key] = err
+					mu.Unlock()
+					continue
+				}
+				table.Add(key, lifeSpan, data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &WarmupError{Errors: errs}
+	}
+	return nil
+}
+
+// ValueBatch returns the items stored for the given keys and marks them to be
+// kept alive, along with the keys which could not be found. Unlike calling
+// Value repeatedly, this only locks the table once and doesn't invoke the
+// data-loader callback.
+func (table *CacheTable) ValueBatch(keys []interface{}) (map[interface{}]*CacheItem, []interface{}) {
+	found := make(map[interface{}]*CacheItem, len(keys))
+	var missing []interface{}
+
+	table.RLock()
+	for _, key := range keys {
+		if r, ok := table.items[key]; ok {
+			found[key] = r
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	table.RUnlock()
+
+	for _, r := range found {
+		// Update access counter and timestamp.
+		r.KeepAlive()
+	}
+	atomic.AddInt64(&table.hits, int64(len(found)))
+	atomic.AddInt64(&table.misses, int64(len(missing)))
+
+	return found, missing
+}
+
+// Flush deletes all items from this cache table.
+func (table *CacheTable) Flush() {
+	table.Lock()
+	defer table.Unlock()
+
+	table.log("Flushing table", table.name)
+
+	table.items = make(map[interface{}]*CacheItem)
+	table.negatives = nil
+	atomic.StoreInt64(&table.bytes, 0)
+	if table.expiryHeap != nil {
+		table.expiryHeap = &expiryHeap{}
+	}
+	if table.lruEnabled {
+		table.lru.reset()
+	}
+	table.cleanupInterval = 0
+	if table.cleanupTimer != nil {
+		table.cleanupTimer.Stop()
+	}
+	atomic.StoreInt64(&table.checkDeadline, 0)
+}
+
+// Stop flushes this cache table, stops its expiration timer, closes its
+// eviction channels and removes it from the cache, so calling Cache with the
+// same name creates a new table.
+// The stopped table stays usable as an empty, unregistered table.
+func (table *CacheTable) Stop() {
+	// Hold the cache mutex while reading the name, so RenameTable can't
+	// move the table in between.
+	mutex.Lock()
+	table.RLock()
+	name := table.name
+	table.RUnlock()
+	if cache[name] == table {
+		delete(cache, name)
+	}
+	mutex.Unlock()
+
+	table.Flush()
+
+	table.Lock()
+	for _, ch := range table.evictionChans {
+		close(ch)
+	}
+	table.evictionChans = nil
+	table.Unlock()
+}
+
+// Clone copies all items of this cache table into a new table with the given
+// name, which gets registered like Cache does. It returns ErrTableExists if
+// the name is already taken. The copies keep their data, lifespan, timestamps
+// and access counts, but none of their callbacks. Items which already
+// exceeded their lifespan are left out. Apart from the expiration mode, the
+// table's configuration is not copied.
+func (table *CacheTable) Clone(newName string) (*CacheTable, error) {
+	table.RLock()
+	now := time.Now()
+	expireByCreateTime := table.expireByCreateTime
+	items := make([]*CacheItem, 0, len(table.items))
+	for _, item := range table.items {
+		if table.staleInternal(item, now) {
+			continue
+		}
+		items = append(items, item.cloneWith(item.Data()))
+	}
+	table.RUnlock()
+
+	mutex.Lock()
+	if _, ok := cache[newName]; ok {
+		mutex.Unlock()
+		return nil, ErrTableExists
+	}
+	clone := newCacheTable(newName, expireByCreateTime)
+	// Keep others from seeing the new table before its items got added.
+	clone.Lock()
+	cache[newName] = clone
+	mutex.Unlock()
+
+	clone.addInternal(items...)
+
+	return clone, nil
+}
+
+// Metrics is a snapshot of a cache table's statistics.
+type Metrics struct {
+	// Lookups via Value which found an item.
+	Hits int64
+	// Lookups via Value which didn't find an item.
+	Misses int64
+	// Items added to the table.
+	Adds int64
+	// Items removed via Delete, DeleteBatch or DeleteFunc.
+	Deletes int64
+	// Items removed to stay within the table's limits or heap threshold.
+	Evictions int64
+	// Items removed because they exceeded their lifespan, by the expiration
+	// check or lazy expiration.
+	Expirations int64
+	// Items currently stored in the table.
+	Items int64
+	// How often Add or Value had to wait for the table lock, if enabled via
+	// SetLockContentionTracking.
+	LockContention int64
+}
+
+// Metrics returns a snapshot of this cache table's statistics.
+func (table *CacheTable) Metrics() Metrics {
+	return Metrics{
+		Hits:        atomic.LoadInt64(&table.hits),
+		Misses:      atomic.LoadInt64(&table.misses),
+		Adds:        atomic.LoadInt64(&table.adds),
+		Deletes:     atomic.LoadInt64(&table.deletes),
+		Evictions:   atomic.LoadInt64(&table.evictions),
+		Expirations: atomic.LoadInt64(&table.expirations),
+		Items:       int64(table.Count()),
+
+		LockContention: atomic.LoadInt64(&table.contention),
+	}
+}
+
+// Stats returns how many lookups via Value were hits and misses, and how many
+// items have been added to this cache table. See Metrics for more statistics.
+func (table *CacheTable) Stats() (hits, misses, adds int64) {
+	m := table.Metrics()
+	return m.Hits, m.Misses, m.Adds
+}
+
+// ResetStats resets all statistics of this cache table to zero.
+func (table *CacheTable) ResetStats() {
+	atomic.StoreInt64(&table.hits, 0)
+	atomic.StoreInt64(&table.misses, 0)
+	atomic.StoreInt64(&table.adds, 0)
+	atomic.StoreInt64(&table.deletes, 0)
+	atomic.StoreInt64(&table.evictions, 0)
+	atomic.StoreInt64(&table.expirations, 0)
+	atomic.StoreInt64(&table.contention, 0)
+}
+
+// CacheItemPair maps key to access counter
 type CacheItemPair struct {
 	Key         interface{}
 	AccessCount int64
@@ -345,7 +1767,7 @@ func (table *CacheTable) MostAccessed(count int64) []*CacheItem {
 	p := make(CacheItemPairList, len(table.items))
 	i := 0
 	for k, v := range table.items {
-		p[i] = CacheItemPair{k, v.accessCount}
+		p[i] = CacheItemPair{k, v.AccessCount()}
 		i++
 	}
 	sort.Sort(p)
@@ -367,6 +1789,214 @@ func (table *CacheTable) MostAccessed(count int64) []*CacheItem {
 	return r
 }
 
+// lockCounted locks the table and counts whether it had to wait, if enabled.
+func (table *CacheTable) lockCounted() {
+	if atomic.LoadInt32(&table.countContention) != 0 {
+		if table.TryLock() {
+			return
+		}
+		atomic.AddInt64(&table.contention, 1)
+	}
+	table.Lock()
+}
+
+// rLockCounted read-locks the table and counts whether it had to wait, if
+// enabled.
+func (table *CacheTable) rLockCounted() {
+	if atomic.LoadInt32(&table.countContention) != 0 {
+		if table.TryRLock() {
+			return
+		}
+		atomic.AddInt64(&table.contention, 1)
+	}
+	table.RLock()
+}
+
+// lockBefore locks the table like Lock, but if ctx has a deadline, it polls
+// like ValueTimeout and gives up once the deadline passed. It returns whether
+// the table got locked.
+func (table *CacheTable) lockBefore(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		table.Lock()
+		return true
+	}
+
+	for !table.TryLock() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(lockRetryInterval)
+	}
+	return true
+}
+
+// overLimit returns whether the table holds more items than it should.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) overLimit() bool {
+	return (table.maxItems > 0 && len(table.items) > table.maxItems) ||
+		(table.maxBytes > 0 && atomic.LoadInt64(&table.bytes) > table.maxBytes)
+}
+
+// sizeOfInternal returns the size of an item, or 0 if no size callback is set.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) sizeOfInternal(item *CacheItem) int64 {
+	if table.sizeOf == nil {
+		return 0
+	}
+	return table.sizeOf(item)
+}
+
+// evictInternal removes the lowest priority, least recently accessed items
+// until the table is within its limits again.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) evictInternal() {
+	for table.overLimit() {
+		item := table.lru.oldest(func(item *CacheItem) bool {
+			return item.deleting
+		})
+		if item == nil {
+			return
+		}
+		table.evictItemInternal(item)
+	}
+}
+
+// evictItemInternal removes an item to stay within the table's limits or heap
+// threshold.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) evictItemInternal(item *CacheItem) {
+	table.log("Evicting item with key", item.key, "from table", table.name)
+	if table.deleteItemInternal(item) {
+		atomic.AddInt64(&table.evictions, 1)
+		table.publishEvictionInternal(item)
+	} else {
+		// The item isn't in the table anymore, so it mustn't be picked again.
+		table.lru.remove(item)
+	}
+}
+
+// publishEvictionInternal sends an expired or evicted item to all eviction
+// channels which have room for it.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) publishEvictionInternal(item *CacheItem) {
+	for _, ch := range table.evictionChans {
+		select {
+		case ch <- item:
+		default:
+			table.log("Eviction channel full, dropping item with key", item.key, "from table", table.name)
+		}
+	}
+}
+
+// relieveMemoryPressureInternal evicts a fraction of the items, lowest
+// priority and least recently accessed first, if the heap exceeds the
+// configured threshold. The given items, which were just added, are kept.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) relieveMemoryPressureInternal(added []*CacheItem) {
+	if table.heapThreshold == 0 || len(table.items) == 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(table.lastHeapCheck) < heapCheckInterval {
+		return
+	}
+	table.lastHeapCheck = now
+	if heapAlloc() <= table.heapThreshold {
+		return
+	}
+
+	keep := make(map[*CacheItem]bool, len(added))
+	for _, item := range added {
+		keep[item] = true
+	}
+	n := int(float64(len(table.items)) * heapEvictFraction)
+	if n < 1 {
+		n = 1
+	}
+	table.log("Heap exceeds", table.heapThreshold, "bytes, evicting", n, "items from table", table.name)
+	for i := 0; i < n; i++ {
+		item := table.lru.oldest(func(item *CacheItem) bool {
+			return item.deleting || keep[item]
+		})
+		if item == nil {
+			return
+		}
+		table.evictItemInternal(item)
+	}
+}
+
+func (table *CacheTable) setLifeSpanInternal(item *CacheItem, lifeSpan time.Duration) {
+	// Careful: do not run this method unless the table-mutex is locked!
+	// It will unlock it for the caller before re-scheduling the expiration check
+	item.Lock()
+	item.lifeSpan = lifeSpan
+	item.expiresAt = time.Time{}
+	item.Unlock()
+	table.restartLifeSpan(item)
+
+	// Cache value so we don't keep blocking the mutex.
+	expDur := table.cleanupInterval
+	table.Unlock()
+
+	// Re-schedule the expiration check if the item expires sooner than the next run.
+	if lifeSpan > 0 && (expDur == 0 || lifeSpan < expDur) {
+		table.expirationCheck()
+	}
+}
+
+// setDataInternal replaces the data of an item, keeping the table's total size
+// up to date.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) setDataInternal(item *CacheItem, data interface{}) {
+	size := table.sizeOfInternal(item)
+	item.Lock()
+	item.data = data
+	item.Unlock()
+	atomic.AddInt64(&table.bytes, table.sizeOfInternal(item)-size)
+}
+
+// expiresIn returns how long an item has left until it expires, which is zero
+// or negative if it already exceeded its lifespan. The returned bool is false
+// for items which never expire.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) expiresIn(item *CacheItem, now time.Time) (time.Duration, bool) {
+	return item.expiresIn(now, table.expireByCreateTime)
+}
+
+// staleInternal returns whether an item exceeded its lifespan.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) staleInternal(item *CacheItem, now time.Time) bool {
+	remaining, expires := table.expiresIn(item, now)
+	return expires && remaining <= 0
+}
+
+// restartLifeSpan restarts the expiration clock of an item, depending on
+// whether its lifespan is counted from its creation or last access. Items with
+// an absolute expiry get it moved to one lifespan from now.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) restartLifeSpan(item *CacheItem) {
+	now := time.Now()
+	item.Lock()
+	if !item.expiresAt.IsZero() {
+		item.expiresAt = now.Add(item.lifeSpan)
+	} else if table.slidingInternal(item) {
+		item.accessedOn = now
+	} else {
+		item.createdOn = now
+	}
+	item.Unlock()
+
+	table.scheduleInternal(item)
+}
+
+// slidingInternal returns whether an item's lifespan is counted from its last
+// access rather than its creation.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) slidingInternal(item *CacheItem) bool {
+	return item.sliding(table.expireByCreateTime)
+}
+
 // Internal logging method for convenience.
 func (table *CacheTable) log(v ...interface{}) {
 	if table.logger == nil {
@@ -0,0 +1,65 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+// Package collector exports the statistics of a cache2go table as Prometheus
+// metrics. It lives in its own package, so only users importing it depend on
+// the Prometheus client library.
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cb7960588/cache2go"
+)
+
+var (
+	itemsDesc = prometheus.NewDesc("cache2go_items",
+		"Number of items currently stored in the cache table.",
+		[]string{"table"}, nil)
+	hitsDesc = prometheus.NewDesc("cache2go_hits_total",
+		"Number of lookups which found the requested item.",
+		[]string{"table"}, nil)
+	missesDesc = prometheus.NewDesc("cache2go_misses_total",
+		"Number of lookups which didn't find the requested item.",
+		[]string{"table"}, nil)
+	addsDesc = prometheus.NewDesc("cache2go_adds_total",
+		"Number of items added to the cache table.",
+		[]string{"table"}, nil)
+)
+
+// Collector is a prometheus.Collector exporting the statistics of a cache
+// table.
+type Collector struct {
+	table *cache2go.CacheTable
+}
+
+// New returns a Collector for the given cache table. The table's name is
+// exported as the "table" label of all metrics.
+func New(table *cache2go.CacheTable) *Collector {
+	return &Collector{
+		table: table,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- itemsDesc
+	ch <- hitsDesc
+	ch <- missesDesc
+	ch <- addsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	name := c.table.Name()
+	hits, misses, adds := c.table.Stats()
+
+	ch <- prometheus.MustNewConstMetric(itemsDesc, prometheus.GaugeValue, float64(c.table.Count()), name)
+	ch <- prometheus.MustNewConstMetric(hitsDesc, prometheus.CounterValue, float64(hits), name)
+	ch <- prometheus.MustNewConstMetric(missesDesc, prometheus.CounterValue, float64(misses), name)
+	ch <- prometheus.MustNewConstMetric(addsDesc, prometheus.CounterValue, float64(adds), name)
+}
@@ -0,0 +1,43 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package collector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cb7960588/cache2go"
+)
+
+func TestCollector(t *testing.T) {
+	table := cache2go.Cache("testCollector", false)
+	table.Add("a", 0, 1)
+	table.Add("b", 0, 2)
+	_, _ = table.Value("a")
+	_, _ = table.Value("c")
+
+	expected := `
+# HELP cache2go_adds_total Number of items added to the cache table.
+# TYPE cache2go_adds_total counter
+cache2go_adds_total{table="testCollector"} 2
+# HELP cache2go_hits_total Number of lookups which found the requested item.
+# TYPE cache2go_hits_total counter
+cache2go_hits_total{table="testCollector"} 1
+# HELP cache2go_items Number of items currently stored in the cache table.
+# TYPE cache2go_items gauge
+cache2go_items{table="testCollector"} 2
+# HELP cache2go_misses_total Number of lookups which didn't find the requested item.
+# TYPE cache2go_misses_total counter
+cache2go_misses_total{table="testCollector"} 1
+`
+	if err := testutil.CollectAndCompare(New(table), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
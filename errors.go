@@ -9,6 +9,7 @@ package cache2go
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
@@ -17,4 +18,60 @@ var (
 	// ErrKeyNotFoundOrLoadable gets returned when a specific key couldn't be
 	// found and loading via the data-loader callback also failed
 	ErrKeyNotFoundOrLoadable = errors.New("Key not found and could not be loaded into cache")
+	// ErrNegativeCached gets returned when a specific key couldn't be
+	// loaded recently and the data-loader callback wasn't tried again
+	ErrNegativeCached = errors.New("Key recently could not be loaded into cache")
+	// ErrTypeMismatch gets returned when a cached value is not of the
+	// requested type
+	ErrTypeMismatch = errors.New("Cached value is not of the requested type")
+	// ErrCacheFull gets returned when adding an item would exceed a table's
+	// limits
+	ErrCacheFull = errors.New("Cache table is full")
+	// ErrLockTimeout gets returned when a table couldn't be locked in time
+	ErrLockTimeout = errors.New("Timed out waiting for the table lock")
+	// ErrNoItemDecoder gets returned when loading encoded items without an
+	// item decoder
+	ErrNoItemDecoder = errors.New("Item decoder required to load encoded items")
+	// ErrTableFrozen gets returned when modifying a frozen table
+	ErrTableFrozen = errors.New("Table is frozen")
+	// ErrTableNotFound gets returned when a specific table couldn't be found
+	ErrTableNotFound = errors.New("Table not found")
+	// ErrTableExists gets returned when a table with the given name already
+	// exists
+	ErrTableExists = errors.New("Table already exists")
 )
+
+// errExpirationVetoed gets returned internally when an about-to-expire
+// callback kept an expired item in the cache.
+var errExpirationVetoed = errors.New("Expiration vetoed by callback")
+
+// KeyNotFoundError gets returned when a specific key couldn't be found. It
+// matches ErrKeyNotFound when compared with errors.Is.
+type KeyNotFoundError struct {
+	Key interface{}
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrKeyNotFound, e.Key)
+}
+
+// Is reports whether target is ErrKeyNotFound.
+func (e *KeyNotFoundError) Is(target error) bool {
+	return target == ErrKeyNotFound
+}
+
+// WarmupError gets returned by Warmup when some keys couldn't be loaded.
+type WarmupError struct {
+	// The error returned by the loader, by key.
+	Errors map[interface{}]error
+}
+
+func (e *WarmupError) Error() string {
+	for key, err := range e.Errors {
+		if len(e.Errors) == 1 {
+			return fmt.Sprintf("Warmup failed for key %v: %s", key, err)
+		}
+		return fmt.Sprintf("Warmup failed for %d keys, e.g. %v: %s", len(e.Errors), key, err)
+	}
+	return "Warmup failed"
+}
@@ -0,0 +1,127 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryHeap is a min-heap of items, ordered by when they are due. Every item
+// is in it at most once and keeps track of its position, so it can be moved
+// or removed when its lifespan changes or it gets deleted.
+type expiryHeap []*CacheItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].heapDeadline.Before(h[j].heapDeadline) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i + 1
+	h[j].heapIndex = j + 1
+}
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*CacheItem)
+	item.heapIndex = len(*h) + 1
+	*h = append(*h, item)
+}
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.heapIndex = 0
+	*h = old[:n-1]
+	return item
+}
+
+// SetHeapExpiration makes the expiration check keep track of items in a heap
+// ordered by expiry, so it only looks at items which are due instead of
+// scanning the whole table. This pays off for large tables where few items
+// expire at a time, at the cost of some memory per item.
+func (table *CacheTable) SetHeapExpiration(enabled bool) {
+	table.Lock()
+	defer table.Unlock()
+
+	if !enabled {
+		table.expiryHeap = nil
+		return
+	}
+	if table.expiryHeap == nil {
+		table.rebuildExpiryHeapInternal()
+	}
+}
+
+// rebuildExpiryHeapInternal schedules all items in a new expiry heap.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) rebuildExpiryHeapInternal() {
+	table.expiryHeap = &expiryHeap{}
+	for _, item := range table.items {
+		item.heapIndex = 0
+		table.scheduleInternal(item)
+	}
+}
+
+// scheduleInternal moves an item to its current deadline in the expiry heap,
+// if enabled, adding it if necessary.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) scheduleInternal(item *CacheItem) {
+	if table.expiryHeap == nil {
+		return
+	}
+
+	now := time.Now()
+	remaining, expires := table.expiresIn(item, now)
+	if !expires {
+		table.unscheduleInternal(item)
+		return
+	}
+	item.heapDeadline = now.Add(remaining)
+	if item.heapIndex > 0 {
+		heap.Fix(table.expiryHeap, item.heapIndex-1)
+	} else {
+		heap.Push(table.expiryHeap, item)
+	}
+}
+
+// unscheduleInternal removes an item from the expiry heap, if it is in it.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) unscheduleInternal(item *CacheItem) {
+	if table.expiryHeap != nil && item.heapIndex > 0 {
+		heap.Remove(table.expiryHeap, item.heapIndex-1)
+	}
+	item.heapDeadline = time.Time{}
+}
+
+// popExpiredInternal pops all items from the expiry heap which are due and
+// returns those which actually expired, along with how long until the next
+// item is due. Items which were kept alive in the meantime get rescheduled.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) popExpiredInternal(now time.Time) ([]*CacheItem, time.Duration) {
+	h := table.expiryHeap
+	var expired []*CacheItem
+	for h.Len() > 0 {
+		item := (*h)[0]
+		if item.heapDeadline.After(now) {
+			return expired, item.heapDeadline.Sub(now)
+		}
+
+		remaining, expires := table.expiresIn(item, now)
+		if expires && remaining > 0 {
+			item.heapDeadline = now.Add(remaining)
+			heap.Fix(h, 0)
+			continue
+		}
+		heap.Pop(h)
+		item.heapDeadline = time.Time{}
+		if expires {
+			expired = append(expired, item)
+		}
+	}
+
+	return expired, 0
+}
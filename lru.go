@@ -0,0 +1,181 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+)
+
+// lruList keeps the items of a table in access order, with one list per
+// priority, so the least recently accessed item of the lowest priority can be
+// found without looking at all items. It has its own mutex, so accessing an
+// item doesn't need the table's write lock.
+type lruList struct {
+	sync.Mutex
+
+	// Items by priority, most recently accessed first.
+	lists map[int]*list.List
+	// The priorities in lists, in ascending order.
+	priorities []int
+}
+
+func newLRUList() *lruList {
+	return &lruList{
+		lists: make(map[int]*list.List),
+	}
+}
+
+// pushInternal adds an item as the most recently accessed one of its
+// priority.
+// Careful: do not run this method unless the list's mutex is locked!
+func (l *lruList) pushInternal(item *CacheItem) {
+	pl, ok := l.lists[item.priority]
+	if !ok {
+		pl = list.New()
+		l.lists[item.priority] = pl
+		i := sort.SearchInts(l.priorities, item.priority)
+		l.priorities = append(l.priorities, 0)
+		copy(l.priorities[i+1:], l.priorities[i:])
+		l.priorities[i] = item.priority
+	}
+	item.lruElement = pl.PushFront(item)
+}
+
+// push adds an item as the most recently accessed one of its priority.
+func (l *lruList) push(item *CacheItem) {
+	l.Lock()
+	defer l.Unlock()
+	l.pushInternal(item)
+}
+
+// touch marks an item as the most recently accessed one of its priority, if
+// it is in the list.
+func (l *lruList) touch(item *CacheItem) {
+	l.Lock()
+	defer l.Unlock()
+	if item.lruElement != nil {
+		l.lists[item.priority].MoveToFront(item.lruElement)
+	}
+}
+
+// remove takes an item out of the list, if it is in it.
+func (l *lruList) remove(item *CacheItem) {
+	l.Lock()
+	defer l.Unlock()
+	if item.lruElement == nil {
+		return
+	}
+
+	pl := l.lists[item.priority]
+	pl.Remove(item.lruElement)
+	item.lruElement = nil
+	if pl.Len() == 0 {
+		delete(l.lists, item.priority)
+		i := sort.SearchInts(l.priorities, item.priority)
+		l.priorities = append(l.priorities[:i], l.priorities[i+1:]...)
+	}
+}
+
+// reset takes all items out of the list.
+func (l *lruList) reset() {
+	l.Lock()
+	defer l.Unlock()
+	for _, pl := range l.lists {
+		for e := pl.Front(); e != nil; e = e.Next() {
+			e.Value.(*CacheItem).lruElement = nil
+		}
+	}
+	l.lists = make(map[int]*list.List)
+	l.priorities = nil
+}
+
+// oldest returns the least recently accessed item of the lowest priority for
+// which skip returns false, or nil if there is none.
+func (l *lruList) oldest(skip func(*CacheItem) bool) *CacheItem {
+	l.Lock()
+	defer l.Unlock()
+	for _, p := range l.priorities {
+		for e := l.lists[p].Back(); e != nil; e = e.Prev() {
+			if item := e.Value.(*CacheItem); !skip(item) {
+				return item
+			}
+		}
+	}
+
+	return nil
+}
+
+// updateLRUInternal starts or stops keeping the items in access order,
+// depending on whether the table has any limits or a heap threshold which
+// require evicting them.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) updateLRUInternal() {
+	enabled := table.maxItems > 0 || table.maxBytes > 0 || table.heapThreshold > 0
+	if enabled == table.lruEnabled {
+		return
+	}
+	table.lruEnabled = enabled
+	if table.lru == nil {
+		table.lru = newLRUList()
+	}
+
+	var lru *lruList
+	if enabled {
+		lru = table.lru
+		type candidate struct {
+			item       *CacheItem
+			accessedOn int64
+		}
+		candidates := make([]candidate, 0, len(table.items))
+		for _, item := range table.items {
+			candidates = append(candidates, candidate{item, item.AccessedOn().UnixNano()})
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].accessedOn < candidates[j].accessedOn
+		})
+
+		lru.Lock()
+		for _, c := range candidates {
+			lru.pushInternal(c.item)
+		}
+		lru.Unlock()
+	} else {
+		table.lru.reset()
+	}
+
+	for _, item := range table.items {
+		item.Lock()
+		item.lru = lru
+		item.Unlock()
+	}
+}
+
+// trackInternal adds a newly added item to the access order, if enabled.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) trackInternal(item *CacheItem) {
+	if !table.lruEnabled {
+		return
+	}
+
+	table.lru.push(item)
+	item.Lock()
+	item.lru = table.lru
+	item.Unlock()
+}
+
+// untrackInternal removes an item which left the table from the access order
+// and the expiry heap.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) untrackInternal(item *CacheItem) {
+	table.unscheduleInternal(item)
+	if table.lruEnabled {
+		table.lru.remove(item)
+	}
+}
@@ -0,0 +1,33 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+// MultiGetBuilder collects keys to look up together with ValueBatch.
+type MultiGetBuilder struct {
+	table *CacheTable
+	keys  []interface{}
+}
+
+// MultiGet returns a builder to look up several keys at once, e.g.
+// table.MultiGet().Add(k1).Add(k2).Do().
+func (table *CacheTable) MultiGet() *MultiGetBuilder {
+	return &MultiGetBuilder{table: table}
+}
+
+// Add adds a key to look up and returns the builder.
+func (b *MultiGetBuilder) Add(key interface{}) *MultiGetBuilder {
+	b.keys = append(b.keys, key)
+	return b
+}
+
+// Do looks up all added keys via ValueBatch and returns the items found, by
+// key. Missing keys are left out.
+func (b *MultiGetBuilder) Do() map[interface{}]*CacheItem {
+	found, _ := b.table.ValueBatch(b.keys)
+	return found
+}
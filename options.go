@@ -0,0 +1,31 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"log"
+)
+
+// Option configures a cache table when Cache creates it.
+type Option func(table *CacheTable)
+
+// WithInitialCapacity pre-sizes the table for the given number of items, so
+// bulk-loading it doesn't repeatedly grow its item map.
+func WithInitialCapacity(capacity int) Option {
+	return func(table *CacheTable) {
+		table.items = make(map[interface{}]*CacheItem, capacity)
+	}
+}
+
+// WithLogger makes the table log to logger from the start, including its
+// first expiration check. See CacheTable.SetLogger.
+func WithLogger(logger *log.Logger) Option {
+	return func(table *CacheTable) {
+		table.logger = logger
+	}
+}
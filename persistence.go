@@ -0,0 +1,390 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// persistedTable is the on-disk representation of a cache table.
+type persistedTable struct {
+	// When the table was saved.
+	SavedOn time.Time
+	// All items which hadn't expired yet.
+	Items []persistedItem
+}
+
+// persistedItem is the on-disk representation of a cached item.
+type persistedItem struct {
+	Key  interface{}
+	Data interface{}
+	// The item as returned by the item encoder, replacing Key and Data.
+	Encoded []byte
+	// The item's remaining lifespan when it was saved, 0 if it never expires.
+	LifeSpan time.Duration
+	// The item's full lifespan, 0 in files written before it was saved.
+	FullLifeSpan time.Duration
+	// The item's absolute expiry, if any, its policy and priority.
+	ExpiresAt time.Time
+	Policy    ExpirationPolicy
+	Priority  int
+}
+
+// SetItemEncoder configures a callback encoding items for SaveToFile and
+// MarshalJSON, e.g. for values which encoding/gob or encoding/json can't
+// handle. Without an encoder, keys and values are stored as they are.
+func (table *CacheTable) SetItemEncoder(f func(item *CacheItem) ([]byte, error)) {
+	table.Lock()
+	defer table.Unlock()
+	table.itemEncoder = f
+}
+
+// SetItemDecoder configures a callback turning the output of the item encoder
+// back into an item for LoadFromFile and LoadFrom. The item's lifespan,
+// expiry, policy and priority get replaced by the saved ones.
+func (table *CacheTable) SetItemDecoder(f func(data []byte) (*CacheItem, error)) {
+	table.Lock()
+	defer table.Unlock()
+	table.itemDecoder = f
+}
+
+// SaveToFile writes all items of this cache table and their remaining
+// lifespans to the given file. Unless an item encoder is set, keys and values
+// are encoded with encoding/gob, so custom types need to be registered with
+// gob.Register.
+func (table *CacheTable) SaveToFile(path string) error {
+	table.RLock()
+	now := time.Now()
+	encoder := table.itemEncoder
+	items := make([]*CacheItem, 0, len(table.items))
+	pt := persistedTable{
+		SavedOn: now,
+		Items:   make([]persistedItem, 0, len(table.items)),
+	}
+	for key, item := range table.items {
+		remaining, expires := table.expiresIn(item, now)
+		if !expires {
+			remaining = 0
+		} else if remaining <= 0 {
+			continue
+		}
+
+		items = append(items, item)
+		item.RLock()
+		pt.Items = append(pt.Items, persistedItem{
+			Key:          key,
+			Data:         item.data,
+			LifeSpan:     remaining,
+			FullLifeSpan: item.lifeSpan,
+			ExpiresAt:    item.expiresAt,
+			Policy:       item.policy,
+			Priority:     item.priority,
+		})
+		item.RUnlock()
+	}
+	table.RUnlock()
+
+	if encoder != nil {
+		for i, item := range items {
+			encoded, err := encoder(item)
+			if err != nil {
+				return err
+			}
+			pt.Items[i].Key, pt.Items[i].Data, pt.Items[i].Encoded = nil, nil, encoded
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(pt); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LoadFromFile adds all items previously written by SaveToFile to this cache
+// table, keeping their lifespans, expiry, policy and priority. Their
+// expiration clocks continue where they were when the file was written,
+// minus the time passed since. Items which expired since are skipped. Items
+// written with an item encoder require an item decoder.
+func (table *CacheTable) LoadFromFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var pt persistedTable
+	if err := gob.NewDecoder(f).Decode(&pt); err != nil {
+		return err
+	}
+
+	table.RLock()
+	decoder := table.itemDecoder
+	table.RUnlock()
+
+	elapsed := time.Since(pt.SavedOn)
+	items := make([]*CacheItem, 0, len(pt.Items))
+	for _, pi := range pt.Items {
+		remaining := pi.LifeSpan
+		if remaining > 0 {
+			remaining -= elapsed
+			if remaining <= 0 {
+				continue
+			}
+		}
+
+		item := NewCacheItem(pi.Key, 0, pi.Data)
+		if pi.Encoded != nil {
+			if decoder == nil {
+				return ErrNoItemDecoder
+			}
+			var err error
+			if item, err = decoder(pi.Encoded); err != nil {
+				return err
+			}
+		}
+		restoreItem(item, pi.FullLifeSpan, remaining, pi.ExpiresAt, pi.Policy, pi.Priority)
+		items = append(items, item)
+	}
+
+	table.Lock()
+	if table.frozen {
+		table.Unlock()
+		return ErrTableFrozen
+	}
+	table.addInternal(items...)
+
+	return nil
+}
+
+// jsonTable is the JSON representation of a cache table.
+type jsonTable struct {
+	Name  string     `json:"name"`
+	Items []jsonItem `json:"items"`
+}
+
+// jsonItem is the JSON representation of a cached item.
+type jsonItem struct {
+	Key       interface{}   `json:"key,omitempty"`
+	Value     interface{}   `json:"value,omitempty"`
+	Encoded   []byte        `json:"encoded,omitempty"`
+	CreatedOn time.Time     `json:"createdOn"`
+	LifeSpan  time.Duration `json:"lifeSpan"`
+}
+
+// MarshalJSON implements json.Marshaler and returns a snapshot of all items in
+// this cache table. Keys which can't be represented in JSON are replaced by
+// their default string format. If an item encoder is set, its output replaces
+// each item's key and value.
+func (table *CacheTable) MarshalJSON() ([]byte, error) {
+	table.RLock()
+	encoder := table.itemEncoder
+	items := make([]*CacheItem, 0, len(table.items))
+	jt := jsonTable{
+		Name:  table.name,
+		Items: make([]jsonItem, 0, len(table.items)),
+	}
+	for key, item := range table.items {
+		item.RLock()
+		items = append(items, item)
+		jt.Items = append(jt.Items, jsonItem{
+			Key:       key,
+			Value:     item.data,
+			CreatedOn: item.createdOn,
+			LifeSpan:  item.lifeSpan,
+		})
+		item.RUnlock()
+	}
+	table.RUnlock()
+
+	for i, ji := range jt.Items {
+		if encoder != nil {
+			encoded, err := encoder(items[i])
+			if err != nil {
+				return nil, err
+			}
+			jt.Items[i].Key, jt.Items[i].Value, jt.Items[i].Encoded = nil, nil, encoded
+			continue
+		}
+		if _, err := json.Marshal(ji.Key); err != nil {
+			jt.Items[i].Key = fmt.Sprint(ji.Key)
+		}
+	}
+
+	return json.Marshal(jt)
+}
+
+// loadBatchSize is how many items LoadFrom adds to the table at once.
+const loadBatchSize = 1000
+
+// dumpedItem is a line written by DumpTo.
+type dumpedItem struct {
+	Key     interface{} `json:"key,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	Encoded []byte      `json:"encoded,omitempty"`
+	// When the item expires, nil if it never expires.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Whether ExpiresAt is the item's absolute expiry rather than the end of
+	// its current lifespan.
+	Absolute bool `json:"absolute,omitempty"`
+	// The item's full lifespan, policy and priority.
+	LifeSpan time.Duration    `json:"lifeSpan,omitempty"`
+	Policy   ExpirationPolicy `json:"policy,omitempty"`
+	Priority int              `json:"priority,omitempty"`
+}
+
+// DumpTo writes all items of this cache table to w as newline-delimited JSON,
+// one item per line, for LoadFrom to read back in. The table is only locked
+// while copying the pointers to its items and its expiration mode. Each item
+// is then read and written one at a time, so changes made to an item while
+// dumping may or may not be included. If an item encoder is set, its output
+// replaces each item's key and value.
+func (table *CacheTable) DumpTo(w io.Writer) error {
+	table.RLock()
+	now := time.Now()
+	encoder := table.itemEncoder
+	expireByCreateTime := table.expireByCreateTime
+	items := make([]*CacheItem, 0, len(table.items))
+	for _, item := range table.items {
+		items = append(items, item)
+	}
+	table.RUnlock()
+
+	enc := json.NewEncoder(w)
+	for _, item := range items {
+		var di dumpedItem
+		remaining, expires := item.expiresIn(now, expireByCreateTime)
+		if expires {
+			if remaining <= 0 {
+				continue
+			}
+			expiresAt := now.Add(remaining)
+			di.ExpiresAt = &expiresAt
+		}
+		item.RLock()
+		if encoder == nil {
+			di.Key, di.Value = item.key, item.data
+		}
+		di.Absolute = !item.expiresAt.IsZero()
+		di.LifeSpan, di.Policy, di.Priority = item.lifeSpan, item.policy, item.priority
+		item.RUnlock()
+
+		if encoder != nil {
+			encoded, err := encoder(item)
+			if err != nil {
+				return err
+			}
+			di.Encoded = encoded
+		}
+		if err := enc.Encode(di); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadFrom reads items written by DumpTo from r and adds them to this cache
+// table as it goes, skipping items which expired in the meantime. Like
+// LoadFromFile, it keeps the items' lifespans, expiry, policy and priority.
+// Keys and values come back as the types encoding/json decodes them to, e.g.
+// float64 for numbers, unless an item decoder is set.
+func (table *CacheTable) LoadFrom(r io.Reader) error {
+	table.RLock()
+	decoder := table.itemDecoder
+	table.RUnlock()
+
+	add := func(items []*CacheItem) error {
+		if len(items) == 0 {
+			return nil
+		}
+		table.Lock()
+		if table.frozen {
+			table.Unlock()
+			return ErrTableFrozen
+		}
+		table.addInternal(items...)
+		return nil
+	}
+
+	dec := json.NewDecoder(r)
+	batch := make([]*CacheItem, 0, loadBatchSize)
+	for {
+		var di dumpedItem
+		if err := dec.Decode(&di); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var remaining time.Duration
+		var expiresAt time.Time
+		if di.ExpiresAt != nil {
+			remaining = time.Until(*di.ExpiresAt)
+			if remaining <= 0 {
+				continue
+			}
+			if di.Absolute {
+				expiresAt = *di.ExpiresAt
+			}
+		}
+
+		item := NewCacheItem(di.Key, 0, di.Value)
+		if di.Encoded != nil {
+			if decoder == nil {
+				return ErrNoItemDecoder
+			}
+			var err error
+			if item, err = decoder(di.Encoded); err != nil {
+				return err
+			}
+		}
+		restoreItem(item, di.LifeSpan, remaining, expiresAt, di.Policy, di.Priority)
+
+		batch = append(batch, item)
+		if len(batch) == loadBatchSize {
+			if err := add(batch); err != nil {
+				return err
+			}
+			batch = make([]*CacheItem, 0, loadBatchSize)
+		}
+	}
+
+	return add(batch)
+}
+
+// restoreItem applies the saved expiry settings to a loaded item, which isn't
+// in any table yet. remaining is how much of lifeSpan is left, 0 if the item
+// never expires. Its clock is set back, so the lifespan is over after
+// remaining no matter whether it's counted from creation or last access.
+func restoreItem(item *CacheItem, lifeSpan, remaining time.Duration,
+	expiresAt time.Time, policy ExpirationPolicy, priority int) {
+	if lifeSpan < remaining {
+		// Saved without the full lifespan.
+		lifeSpan = remaining
+	}
+
+	item.lifeSpan = lifeSpan
+	item.expiresAt = expiresAt
+	item.policy = policy
+	item.priority = priority
+	if expiresAt.IsZero() && remaining > 0 {
+		clock := time.Now().Add(remaining - lifeSpan)
+		item.createdOn, item.accessedOn = clock, clock
+	}
+}
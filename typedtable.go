@@ -0,0 +1,70 @@
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// ValueAs returns the value stored for key in table as a T and marks it to be
+// kept alive. See CacheTable.Value. If the stored value is not of type T,
+// ErrTypeMismatch is returned.
+func ValueAs[T any](table *CacheTable, key interface{}) (T, error) {
+	var data T
+	item, err := table.Value(key)
+	if err != nil {
+		return data, err
+	}
+
+	data, ok := item.Data().(T)
+	if !ok {
+		return data, ErrTypeMismatch
+	}
+	return data, nil
+}
+
+// TypedTable is a type-safe wrapper around a CacheTable, so keys and values
+// don't need to be type-asserted by the caller.
+type TypedTable[K comparable, V any] struct {
+	table *CacheTable
+}
+
+// NewTypedTable returns a TypedTable wrapping the given cache table.
+func NewTypedTable[K comparable, V any](table *CacheTable) *TypedTable[K, V] {
+	return &TypedTable[K, V]{
+		table: table,
+	}
+}
+
+// Table returns the underlying cache table.
+func (t *TypedTable[K, V]) Table() *CacheTable {
+	return t.table
+}
+
+// Add adds a key/value pair to the cache. See CacheTable.Add.
+func (t *TypedTable[K, V]) Add(key K, lifeSpan time.Duration, data V) *CacheItem {
+	return t.table.Add(key, lifeSpan, data)
+}
+
+// Value returns the value stored for key and marks it to be kept alive. See
+// CacheTable.Value. If the stored value is not of type V, ErrTypeMismatch is
+// returned.
+func (t *TypedTable[K, V]) Value(key K) (V, error) {
+	return ValueAs[V](t.table, key)
+}
+
+// Exists returns whether an item exists in the cache. See CacheTable.Exists.
+func (t *TypedTable[K, V]) Exists(key K) bool {
+	return t.table.Exists(key)
+}
+
+// Delete an item from the cache. See CacheTable.Delete.
+func (t *TypedTable[K, V]) Delete(key K) error {
+	_, err := t.table.Delete(key)
+	return err
+}